@@ -0,0 +1,153 @@
+package main
+
+import (
+	"biocad-tsv-service/internal/migrations"
+	"biocad-tsv-service/internal/worker"
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"log"
+	"strconv"
+)
+
+// runCommand runs a one-off maintenance command given on the command line instead of the service.
+// It reports false if args don't name a command.
+func runCommand(ctx context.Context, args []string, db *pgxpool.Pool, processor *worker.Processor) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+
+	switch args[0] {
+	case "requeue":
+		return true, requeue(ctx, processor, args[1:])
+	case "reprocess":
+		return true, eachFile(args[1:], func(id uuid.UUID) error {
+			file, err := processor.Reprocess(ctx, id)
+			if err != nil {
+				return err
+			}
+			log.Printf("[reprocess] file %s will be ingested again from %s", id, file.Location)
+			return nil
+		})
+	case "purge":
+		return true, eachFile(args[1:], func(id uuid.UUID) error {
+			if _, err := processor.Purge(ctx, id); err != nil {
+				return err
+			}
+			log.Printf("[purge] deleted the data of file %s", id)
+			return nil
+		})
+	case "migrate":
+		return true, migrate(ctx, db, args[1:])
+	default:
+		return true, fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// requeue gives dead files a fresh set of attempts: the ones with the given ids, or all of them
+func requeue(ctx context.Context, processor *worker.Processor, ids []string) error {
+	if len(ids) == 0 {
+		n, err := processor.RequeueDead(ctx)
+		if err != nil {
+			return err
+		}
+		log.Printf("[requeue] requeued %d dead files", n)
+		return nil
+	}
+
+	for _, arg := range ids {
+		id, err := uuid.Parse(arg)
+		if err != nil {
+			return fmt.Errorf("invalid file id %q: %w", arg, err)
+		}
+		requeued, err := processor.Requeue(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !requeued {
+			log.Printf("[requeue] no dead file with id %s", id)
+			continue
+		}
+		log.Printf("[requeue] requeued file %s", id)
+	}
+	return nil
+}
+
+// eachFile runs fn for every file id given on the command line, stopping at the first error
+func eachFile(ids []string, fn func(id uuid.UUID) error) error {
+	if len(ids) == 0 {
+		return fmt.Errorf("no file ids given")
+	}
+	for _, arg := range ids {
+		id, err := uuid.Parse(arg)
+		if err != nil {
+			return fmt.Errorf("invalid file id %q: %w", arg, err)
+		}
+		if err := fn(id); err != nil {
+			return fmt.Errorf("file %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// migrate manages the schema: migrate up | down [n] | status | force <version>
+func migrate(ctx context.Context, db *pgxpool.Pool, args []string) error {
+	migrator, err := migrations.New(db)
+	if err != nil {
+		return err
+	}
+
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	switch action {
+	case "up":
+		n, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		log.Printf("[migrate] applied %d migrations", n)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations to revert %q", args[1])
+			}
+		}
+		n, err := migrator.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+		log.Printf("[migrate] reverted %d migrations", n)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%03d_%s\t%s\n", s.Version, s.Name, applied)
+		}
+	case "force":
+		if len(args) < 2 {
+			return fmt.Errorf("migrate force needs a version")
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil || version < 0 {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		if err := migrator.Force(ctx, version); err != nil {
+			return err
+		}
+		log.Printf("[migrate] schema version set to %d", version)
+	default:
+		return fmt.Errorf("unknown migrate action %q, expected up, down, status or force", action)
+	}
+	return nil
+}
@@ -2,27 +2,27 @@ package main
 
 import (
 	"biocad-tsv-service/internal/api"
+	"biocad-tsv-service/internal/archive"
 	"biocad-tsv-service/internal/config"
 	"biocad-tsv-service/internal/database"
+	"biocad-tsv-service/internal/migrations"
 	"biocad-tsv-service/internal/parser"
-	"biocad-tsv-service/internal/pdf"
 	"biocad-tsv-service/internal/queue"
 	"biocad-tsv-service/internal/repository"
 	"biocad-tsv-service/internal/util"
+	"biocad-tsv-service/internal/worker"
 	"context"
+	"fmt"
 	"github.com/google/uuid"
 	"log"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 	"time"
 )
 
-const numWorkers = 4
-
 func main() {
-	cfg, err := config.LoadConfig("config.yaml")
+	cfg, args, err := config.Load(os.Args[1:])
 	if err != nil {
 		log.Fatalf("[main] failed to load config: %v", err)
 	}
@@ -31,102 +31,170 @@ func main() {
 		log.Fatalf("[main] failed to validate config: %v", err)
 	}
 
+	rules, err := parser.NewRules(cfg.Validation)
+	if err != nil {
+		log.Fatalf("[main] invalid validation rules: %v", err)
+	}
+
+	naturalKey, err := repository.NewNaturalKey(cfg.Ingest.NaturalKey)
+	if err != nil {
+		log.Fatalf("[main] invalid ingest natural key: %v", err)
+	}
+
 	dbPool, err := database.NewPool(cfg)
 	if err != nil {
 		log.Fatalf("[main] failed to connect to database: %v", err)
 	}
 	defer dbPool.Close()
 
-	util.EnsureDirs(cfg.Dirs.Input, cfg.Dirs.Output)
-
-	log.Printf("[main] Loaded config: %s", cfg)
-	log.Println("Service started successfully")
-
 	// create repositories
 	msgRepo := repository.NewMessageRepo(dbPool)
 	pfRepo := repository.NewProcessedFileRepo(dbPool)
 	errRepo := repository.NewParseErrorRepo(dbPool)
+	revRepo := repository.NewRevisionRepo(dbPool)
+
+	parseOpts := parser.Options{
+		Strict:    cfg.Ingest.Mode == config.IngestModeStrict,
+		BatchSize: cfg.Ingest.BatchSize,
+		Rules:     rules,
+
+		NaturalKey:    naturalKey,
+		Upsert:        cfg.Ingest.Write == config.IngestWriteUpsert,
+		DeleteMissing: cfg.Ingest.DeleteMissing,
+	}
+
+	archiver := archive.New(cfg.Dirs.Archive, cfg.Dirs.Failed, cfg.Archive.DatePartition, cfg.Archive.Compress)
+	processor := worker.NewProcessor(
+		dbPool, msgRepo, pfRepo, errRepo, revRepo, cfg.Dirs.Input, cfg.Dirs.Output, parseOpts, archiver, cfg.Retry,
+	)
+
+	// maintenance commands, e.g. `app requeue [file-id...]` or `app migrate status`
+	if ok, err := runCommand(context.Background(), args, dbPool, processor); ok {
+		if err != nil {
+			dbPool.Close()
+			log.Fatalf("[main] command failed: %v", err)
+		}
+		return
+	}
+
+	if cfg.DB.AutoMigrate {
+		migrator, err := migrations.New(dbPool)
+		if err != nil {
+			dbPool.Close()
+			log.Fatalf("[main] failed to load migrations: %v", err)
+		}
+		if _, err := migrator.Up(context.Background()); err != nil {
+			dbPool.Close()
+			log.Fatalf("[main] failed to migrate database: %v", err)
+		}
+	}
+
+	util.EnsureDirs(cfg.Dirs.Input, cfg.Dirs.Output)
+	for _, dir := range []string{cfg.Dirs.Archive, cfg.Dirs.Failed} {
+		if dir != "" {
+			util.EnsureDirs(dir)
+		}
+	}
+
+	log.Printf("[main] Loaded config: %s", cfg)
+	log.Println("Service started successfully")
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	// start API server
-	apiServer := api.NewServer(msgRepo)
+	apiServer := api.NewServer(
+		msgRepo, pfRepo, errRepo, revRepo, processor, naturalKey, cfg.Dirs.Input, cfg.Server.MaxUploadSize,
+	)
 	apiServer.Start(ctx, cfg.Server.Port)
 
-	// channel for files queue
-	fileQueue := make(chan string, 100)
-	var wg sync.WaitGroup
-
-	queueManager := queue.New()
+	// files queue
+	var fileQueue queue.Queue
+	heartbeat := time.Duration(0)
+	if cfg.Queue.Backend == config.QueueBackendPostgres {
+		jobQueue := queue.NewPostgresQueue(
+			repository.NewJobRepo(dbPool), instanceID(), cfg.Queue.Lease, cfg.Queue.PollInterval,
+			cfg.Retry.MaxAttempts, cfg.Queue.Retention,
+		)
+		jobQueue.StartCleanup(ctx)
+		fileQueue = jobQueue
+		heartbeat = cfg.Queue.Lease / 3
+	} else {
+		fileQueue = queue.NewMemoryQueue(cfg.Queue.Size)
+	}
 
 	// start workers
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		go worker(ctx, i, fileQueue, msgRepo, pfRepo, errRepo, queueManager, &wg, cfg.Dirs.Output)
-	}
+	workers := worker.NewPool(ctx, fileQueue, processor, heartbeat)
+	workers.Resize(cfg.Workers.Count)
 
 	// start scanner
-	scanner := queue.NewScanner(cfg.Dirs.Input, pfRepo, fileQueue, queueManager, 30*time.Second)
-	scanner.Start(ctx)
+	scanner := queue.NewScanner(
+		cfg.Dirs.Input,
+		pfRepo,
+		fileQueue,
+		cfg.Scanner.Interval,
+		cfg.Scanner.QuietPeriod,
+		cfg.Scanner.RequireDoneMarker,
+	)
+	var watcher *queue.Watcher // nil when polling
+	if cfg.Scanner.Mode == config.ScannerModeInotify {
+		watcher = queue.NewWatcher(scanner, cfg.Scanner.RescanInterval)
+		if err := watcher.Start(ctx); err != nil {
+			log.Printf("[main] failed to start watcher, falling back to polling: %v", err)
+			watcher = nil
+			scanner.Start(ctx)
+		}
+	} else {
+		scanner.Start(ctx)
+	}
 
-	// graceful shutdown
+	// SIGHUP reloads the config, graceful shutdown on SIGINT/SIGTERM
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-	<-stop
+	for running := true; running; {
+		select {
+		case <-hup:
+			reload(workers, scanner, watcher)
+		case <-stop:
+			running = false
+		}
+	}
 	log.Println("[main] Shutdown signal received, stopping scanner and workers...")
 
-	cancel()         // cancel context for any ongoing operations
-	close(fileQueue) // signal workers to finish
-	wg.Wait()        // wait for all workers
+	cancel()       // cancel context for any ongoing operations, workers stop taking jobs
+	workers.Wait() // wait for all workers
 	log.Println("[main] Service stopped gracefully")
 }
 
-// worker processes files from the queue
-func worker(
-	ctx context.Context,
-	id int,
-	queue <-chan string,
-	msgRepo *repository.MessageRepo,
-	pfRepo *repository.ProcessedFileRepo,
-	errRepo *repository.ParseErrorRepo,
-	qm *queue.Manager,
-	wg *sync.WaitGroup,
-	outDir string,
-) {
-	defer wg.Done()
-	for file := range queue {
-		select {
-		case <-ctx.Done():
-			log.Printf("[worker %d] context canceled, exiting", id)
-			return
-		default:
-		}
-
-		log.Printf("[worker %d] processing file: %s", id, file)
-		messages, err := parser.ParseTSVFile(ctx, file, msgRepo, pfRepo, errRepo)
-		if err != nil {
-			log.Printf("[worker %d] failed to parse file %s: %v", id, file, err)
-			qm.Remove(file)
-			continue
-		} else {
-			log.Printf("[worker %d] successfully parsed file %s", id, file)
-		}
-
-		// generating a PDF for each unique unitGUID
-		unitGUIDMap := make(map[uuid.UUID]struct{})
-		for _, msg := range messages {
-			unitGUIDMap[msg.UnitGUID] = struct{}{}
-		}
+// reload reads the config again and applies the settings that can change at runtime:
+// the worker count, the scan interval and, in inotify mode, the rescan interval. Everything else needs a restart.
+// The scan interval is set in inotify mode too, the watcher falls back to polling when its events stop.
+func reload(workers *worker.Pool, scanner *queue.Scanner, watcher *queue.Watcher) {
+	log.Println("[main] reloading config")
+	cfg, _, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Printf("[main] failed to reload config, keeping the current one: %v", err)
+		return
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Printf("[main] reloaded config is invalid, keeping the current one: %v", err)
+		return
+	}
 
-		for unitGUID := range unitGUIDMap {
-			if err := pdf.GenerateUnitPDF(ctx, outDir, unitGUID, msgRepo); err != nil {
-				log.Printf("[worker %d] failed to generate PDF for %s: %v", id, unitGUID, err)
-			} else {
-				log.Printf("[worker %d] PDF generated for %s", id, unitGUID)
-			}
-		}
+	workers.Resize(cfg.Workers.Count)
+	scanner.SetInterval(cfg.Scanner.Interval)
+	if watcher != nil {
+		watcher.SetRescanInterval(cfg.Scanner.RescanInterval)
+	}
+}
 
-		qm.Remove(file)
+// instanceID identifies this process in the shared jobs table
+func instanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
 	}
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), uuid.NewString()[:8])
 }
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"biocad-tsv-service/internal/models"
+	"biocad-tsv-service/internal/repository"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type ErrorListResponse struct {
+	Page  int                 `json:"page"`
+	Limit int                 `json:"limit"`
+	Total int                 `json:"total"`
+	Data  []models.ParseError `json:"data"`
+}
+
+// handleListErrors handles GET /errors?filename=...&code=...&created_from=...&created_to=...&page=...&limit=...
+func (s *Server) handleListErrors(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	filter := repository.ParseErrorFilter{
+		Filename: query.Get("filename"),
+		Code:     query.Get("code"),
+	}
+	if err := parseTimeParams(query, map[string]*time.Time{
+		"created_from": &filter.CreatedFrom,
+		"created_to":   &filter.CreatedTo,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, limit := pageParams(query)
+
+	total, err := s.ErrRepo.Count(ctx, filter)
+	if err != nil {
+		http.Error(w, "failed to count parse errors", http.StatusInternalServerError)
+		return
+	}
+
+	errs, err := s.ErrRepo.List(ctx, filter, limit, (page-1)*limit)
+	if err != nil {
+		http.Error(w, "failed to query parse errors", http.StatusInternalServerError)
+		return
+	}
+
+	resp := ErrorListResponse{
+		Page:  page,
+		Limit: limit,
+		Total: total,
+		Data:  errs,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"biocad-tsv-service/internal/models"
+	"biocad-tsv-service/internal/worker"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"log"
+	"net/http"
+)
+
+type FileListResponse struct {
+	Page  int                    `json:"page"`
+	Limit int                    `json:"limit"`
+	Total int                    `json:"total"`
+	Data  []models.ProcessedFile `json:"data"`
+}
+
+// fileStatuses are the values accepted by the status filter of GET /files
+var fileStatuses = map[string]struct{}{
+	models.FileStatusQueued:  {},
+	models.FileStatusParsing: {},
+	models.FileStatusSuccess: {},
+	models.FileStatusFailed:  {},
+	models.FileStatusRetry:   {},
+	models.FileStatusDead:    {},
+	models.FileStatusPurged:  {},
+}
+
+// handleListFiles handles GET /files?status=...&page=...&limit=...
+func (s *Server) handleListFiles(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	status := query.Get("status")
+	if _, ok := fileStatuses[status]; status != "" && !ok {
+		http.Error(w, "invalid status", http.StatusBadRequest)
+		return
+	}
+	page, limit := pageParams(query)
+
+	total, err := s.PFRepo.Count(ctx, status)
+	if err != nil {
+		http.Error(w, "failed to count files", http.StatusInternalServerError)
+		return
+	}
+
+	files, err := s.PFRepo.List(ctx, status, limit, (page-1)*limit)
+	if err != nil {
+		http.Error(w, "failed to query files", http.StatusInternalServerError)
+		return
+	}
+
+	resp := FileListResponse{
+		Page:  page,
+		Limit: limit,
+		Total: total,
+		Data:  files,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// handleGetFile handles GET /files/{id}, the file with its row, message and error counters
+func (s *Server) handleGetFile(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid file id", http.StatusBadRequest)
+		return
+	}
+
+	file, err := s.PFRepo.GetByID(r.Context(), id)
+	if err != nil {
+		http.Error(w, "failed to query file", http.StatusInternalServerError)
+		return
+	}
+	if file == nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(file)
+}
+
+// handleRequeueFile handles POST /files/{id}/requeue, a dead file gets a fresh set of attempts
+// and is put back into the input directory
+func (s *Server) handleRequeueFile(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid file id", http.StatusBadRequest)
+		return
+	}
+
+	requeued, err := s.Processor.Requeue(r.Context(), id)
+	if errors.Is(err, worker.ErrSourceMissing) {
+		http.Error(w, "source file is missing", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to requeue file", http.StatusInternalServerError)
+		return
+	}
+	if !requeued {
+		http.Error(w, "no dead file with this id", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRequeueDeadFiles handles POST /files/requeue, every dead file gets a fresh set of attempts
+func (s *Server) handleRequeueDeadFiles(w http.ResponseWriter, r *http.Request) {
+	n, err := s.Processor.RequeueDead(r.Context())
+	if err != nil {
+		http.Error(w, "failed to requeue files", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int64{"requeued": n})
+}
+
+// handleReprocessFile handles POST /files/{id}/reprocess: the messages and parse errors of the file are deleted
+// and the file is put back into the input directory to be ingested again
+func (s *Server) handleReprocessFile(w http.ResponseWriter, r *http.Request) {
+	s.handleFileData(w, r, http.StatusAccepted, s.Processor.Reprocess)
+}
+
+// handlePurgeFile handles DELETE /files/{id}/data: the messages and parse errors of the file are deleted
+// and it is not ingested again until reprocessed
+func (s *Server) handlePurgeFile(w http.ResponseWriter, r *http.Request) {
+	s.handleFileData(w, r, http.StatusOK, s.Processor.Purge)
+}
+
+// handleFileData runs an operation on the data of the file from the path and responds with the updated file
+func (s *Server) handleFileData(
+	w http.ResponseWriter,
+	r *http.Request,
+	status int,
+	op func(ctx context.Context, id uuid.UUID) (*models.ProcessedFile, error),
+) {
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid file id", http.StatusBadRequest)
+		return
+	}
+
+	file, err := op(r.Context(), id)
+	switch {
+	case errors.Is(err, worker.ErrFileNotFound):
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	case errors.Is(err, worker.ErrFileBusy):
+		http.Error(w, "file is queued or being parsed", http.StatusConflict)
+		return
+	case errors.Is(err, worker.ErrSourceMissing):
+		http.Error(w, "source file is missing", http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("[api] failed to update data of file %s: %v", id, err)
+		http.Error(w, "failed to update file data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(file)
+}
@@ -3,12 +3,16 @@ package api
 import (
 	"biocad-tsv-service/internal/models"
 	"biocad-tsv-service/internal/repository"
+	"biocad-tsv-service/internal/worker"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 )
@@ -16,24 +20,68 @@ import (
 // Server holds the dependencies for the API
 type Server struct {
 	MsgRepo *repository.MessageRepo
+	PFRepo  *repository.ProcessedFileRepo
+	ErrRepo *repository.ParseErrorRepo
+	RevRepo *repository.RevisionRepo
+
+	// Processor reprocesses files and deletes their data
+	Processor *worker.Processor
+	// NaturalKey matches the messages of two revisions of a unit
+	NaturalKey repository.NaturalKey
+
+	InputDir      string // uploaded files are written here
+	MaxUploadSize int64  // bytes
 }
 
 type MessageResponse struct {
-	Page  int              `json:"page"`
-	Limit int              `json:"limit"`
-	Total int              `json:"total"`
-	Data  []models.Message `json:"data"`
+	Page       int              `json:"page,omitempty"` // only when paging by page number
+	Limit      int              `json:"limit"`
+	Total      *int             `json:"total,omitempty"`       // only without a cursor, counting is as slow as a deep page
+	NextCursor string           `json:"next_cursor,omitempty"` // empty on the last page
+	Data       []models.Message `json:"data"`
 }
 
 // NewServer creates a new API server instance
-func NewServer(msgRepo *repository.MessageRepo) *Server {
-	return &Server{MsgRepo: msgRepo}
+func NewServer(
+	msgRepo *repository.MessageRepo,
+	pfRepo *repository.ProcessedFileRepo,
+	errRepo *repository.ParseErrorRepo,
+	revRepo *repository.RevisionRepo,
+	processor *worker.Processor,
+	naturalKey repository.NaturalKey,
+	inputDir string,
+	maxUploadSize int64,
+) *Server {
+	return &Server{
+		MsgRepo:       msgRepo,
+		PFRepo:        pfRepo,
+		ErrRepo:       errRepo,
+		RevRepo:       revRepo,
+		Processor:     processor,
+		NaturalKey:    naturalKey,
+		InputDir:      inputDir,
+		MaxUploadSize: maxUploadSize,
+	}
 }
 
 // Start starts the HTTP server on the given port
 func (s *Server) Start(ctx context.Context, port string) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/messages", s.handleGetMessages)
+	mux.HandleFunc("GET /files", s.handleListFiles)
+	mux.HandleFunc("GET /files/{id}", s.handleGetFile)
+	mux.HandleFunc("POST /files", s.handleUploadFile)
+	mux.HandleFunc("GET /jobs/{id}", s.handleGetJob)
+	mux.HandleFunc("POST /files/{id}/requeue", s.handleRequeueFile)
+	mux.HandleFunc("POST /files/requeue", s.handleRequeueDeadFiles)
+	mux.HandleFunc("POST /files/{id}/reprocess", s.handleReprocessFile)
+	mux.HandleFunc("DELETE /files/{id}/data", s.handlePurgeFile)
+	mux.HandleFunc("GET /errors", s.handleListErrors)
+	mux.HandleFunc("GET /units", s.handleListUnits)
+	mux.HandleFunc("GET /units/{guid}", s.handleGetUnit)
+	mux.HandleFunc("GET /units/{guid}/revisions", s.handleListRevisions)
+	mux.HandleFunc("GET /units/{guid}/definition", s.handleGetDefinition)
+	mux.HandleFunc("GET /units/{guid}/diff", s.handleGetDiff)
 
 	server := &http.Server{
 		Addr:    ":" + port,
@@ -57,54 +105,171 @@ func (s *Server) Start(ctx context.Context, port string) {
 	}()
 }
 
-// handleGetMessages handles GET /messages?unit_guid=...&page=...&limit=...
+// handleGetMessages handles GET /messages?unit_guid=...&class=...&page=...&limit=...
+// Every filter is optional, the given ones are combined. Pages are addressed either by the
+// next_cursor of the previous page (?cursor=...) or, for compatibility, by page number.
 func (s *Server) handleGetMessages(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	query := r.URL.Query()
 
-	unitGUIDStr := query.Get("unit_guid")
-	if unitGUIDStr == "" {
-		http.Error(w, "unit_guid is required", http.StatusBadRequest)
+	filter, err := parseMessageFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	unitGUID, err := uuid.Parse(unitGUIDStr)
+	page, limit := pageParams(query)
+
+	var cursor *repository.MessageCursor
+	if v := query.Get("cursor"); v != "" {
+		if cursor, err = decodeCursor(v); err != nil {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	resp := MessageResponse{Limit: limit}
+	if cursor == nil {
+		total, err := s.MsgRepo.Count(ctx, filter)
+		if err != nil {
+			http.Error(w, "failed to count messages", http.StatusInternalServerError)
+			return
+		}
+		resp.Total = &total
+	}
+
+	if cursor != nil {
+		resp.Data, err = s.MsgRepo.ListAfter(ctx, filter, cursor, limit)
+	} else {
+		resp.Page = page
+		resp.Data, err = s.MsgRepo.List(ctx, filter, limit, (page-1)*limit)
+	}
 	if err != nil {
-		http.Error(w, "invalid unit_guid", http.StatusBadRequest)
+		http.Error(w, "failed to query messages", http.StatusInternalServerError)
 		return
 	}
 
-	page, _ := strconv.Atoi(query.Get("page"))
+	// a full page may be followed by more messages
+	if len(resp.Data) == limit {
+		last := resp.Data[len(resp.Data)-1]
+		resp.NextCursor = encodeCursor(repository.MessageCursor{CreatedAt: last.CreatedAt, ID: last.ID})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// pageParams reads page and limit from the query string, applying the defaults and bounds
+func pageParams(query url.Values) (page, limit int) {
+	page, _ = strconv.Atoi(query.Get("page"))
 	if page < 1 {
 		page = 1
 	}
 
-	limit, _ := strconv.Atoi(query.Get("limit"))
+	limit, _ = strconv.Atoi(query.Get("limit"))
 	if limit < 1 || limit > 100 {
 		limit = 50
 	}
+	return page, limit
+}
 
-	offset := (page - 1) * limit
+// parseMessageFilter reads the message filters from the query string
+func parseMessageFilter(query url.Values) (repository.MessageFilter, error) {
+	filter := repository.MessageFilter{
+		MsgID: query.Get("msg_id"),
+		Class: query.Get("class"),
+		Area:  query.Get("area"),
+		Addr:  query.Get("addr"),
+		Type:  query.Get("type"),
+		Text:  query.Get("text"),
+	}
 
-	total, err := s.MsgRepo.CountByUnitGUID(ctx, unitGUID)
-	if err != nil {
-		http.Error(w, "failed to count messages", http.StatusInternalServerError)
-		return
+	if v := query.Get("unit_guid"); v != "" {
+		unitGUID, err := uuid.Parse(v)
+		if err != nil {
+			return filter, errors.New("invalid unit_guid")
+		}
+		filter.UnitGUID = unitGUID
+	}
+	if v := query.Get("source_file_id"); v != "" {
+		fileID, err := uuid.Parse(v)
+		if err != nil {
+			return filter, errors.New("invalid source_file_id")
+		}
+		filter.SourceFileID = fileID
 	}
 
-	messages, err := s.MsgRepo.GetByUnitGUIDPaginated(ctx, unitGUID, limit, offset)
-	if err != nil {
-		http.Error(w, "failed to query messages", http.StatusInternalServerError)
-		return
+	for name, dst := range map[string]**int{
+		"level":       &filter.Level,
+		"level_min":   &filter.LevelMin,
+		"level_max":   &filter.LevelMax,
+		"source_line": &filter.SourceLine,
+	} {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s", name)
+			}
+			*dst = &n
+		}
 	}
 
-	resp := MessageResponse{
-		Page:  page,
-		Limit: limit,
-		Total: total,
-		Data:  messages,
+	err := parseTimeParams(query, map[string]*time.Time{
+		"created_from": &filter.CreatedFrom,
+		"created_to":   &filter.CreatedTo,
+	})
+	return filter, err
+}
+
+// parseTimeParams reads the named time parameters that are present in the query string into dst
+func parseTimeParams(query url.Values, dst map[string]*time.Time) error {
+	for name, t := range dst {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		parsed, err := parseTime(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s, expected RFC 3339 time or YYYY-MM-DD", name)
+		}
+		*t = parsed
 	}
+	return nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(resp)
+// cursorToken is the JSON inside an opaque page cursor
+type cursorToken struct {
+	CreatedAt time.Time `json:"t"`
+	ID        uuid.UUID `json:"id"`
+}
+
+// encodeCursor turns a message position into an opaque URL-safe token
+func encodeCursor(c repository.MessageCursor) string {
+	data, _ := json.Marshal(cursorToken{CreatedAt: c.CreatedAt, ID: c.ID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses a token made by encodeCursor
+func decodeCursor(token string) (*repository.MessageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	var t cursorToken
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, err
+	}
+	if t.ID == uuid.Nil || t.CreatedAt.IsZero() {
+		return nil, errors.New("incomplete cursor")
+	}
+	return &repository.MessageCursor{CreatedAt: t.CreatedAt.UTC(), ID: t.ID}, nil
+}
+
+// parseTime accepts an RFC 3339 timestamp or a date, which means its midnight in UTC.
+// The result is in UTC, the offset of the value only moves it to the same instant
+func parseTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse(time.DateOnly, v)
 }
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"biocad-tsv-service/internal/repository"
+	"encoding/base64"
+	"github.com/google/uuid"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []repository.MessageCursor{
+		{CreatedAt: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), ID: uuid.New()},
+		// the database keeps microseconds, a cursor must not lose them or rows would be skipped or repeated
+		{CreatedAt: time.Date(2024, 5, 1, 10, 0, 0, 123456000, time.UTC), ID: uuid.New()},
+		{CreatedAt: time.Date(2024, 5, 1, 13, 0, 0, 0, time.FixedZone("MSK", 3*3600)), ID: uuid.New()},
+	}
+	for _, want := range tests {
+		token := encodeCursor(want)
+		got, err := decodeCursor(token)
+		if err != nil {
+			t.Fatalf("decodeCursor(%q): %v", token, err)
+		}
+		if !got.CreatedAt.Equal(want.CreatedAt) || got.ID != want.ID {
+			t.Errorf("cursor %+v came back as %+v", want, *got)
+		}
+		if got.CreatedAt.Location() != time.UTC {
+			t.Errorf("cursor time %s is not in UTC", got.CreatedAt)
+		}
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"not base64", "!!!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte(`{"t":"2024-05-01T10:00:00Z"}`))},
+		{"not json", encode("cursor")},
+		{"bad time", encode(`{"t":"yesterday","id":"` + uuid.NewString() + `"}`)},
+		{"bad id", encode(`{"t":"2024-05-01T10:00:00Z","id":"42"}`)},
+		{"no id", encode(`{"t":"2024-05-01T10:00:00Z"}`)},
+		{"no time", encode(`{"id":"` + uuid.NewString() + `"}`)},
+		{"empty", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if c, err := decodeCursor(tt.token); err == nil {
+				t.Errorf("decodeCursor(%q) = %+v, want an error", tt.token, *c)
+			}
+		})
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{value: "2024-05-01T12:30:00Z", want: time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)},
+		{value: "2024-05-01T15:30:00+03:00", want: time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)},
+		{value: "2024-05-01", want: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{value: "01.05.2024", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTime(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTime(%q) = %s, want an error", tt.value, got)
+			}
+			continue
+		}
+		// the repositories pass the time as is, so it must already be in UTC
+		if err != nil || got != tt.want {
+			t.Errorf("parseTime(%q) = %s, %v, want %s", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+// TestTimeParamsUTC checks the values the handlers hand to the repositories
+func TestTimeParamsUTC(t *testing.T) {
+	query := url.Values{
+		"created_from": {"2024-05-01T15:30:00+03:00"},
+		"created_to":   {"2024-05-01T08:30:00-04:00"},
+	}
+	want := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+
+	filter, err := parseMessageFilter(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.CreatedFrom != want || filter.CreatedTo != want {
+		t.Errorf("message filter = %s .. %s, want %s", filter.CreatedFrom, filter.CreatedTo, want)
+	}
+
+	var from, to time.Time
+	if err := parseTimeParams(query, map[string]*time.Time{"created_from": &from, "created_to": &to}); err != nil {
+		t.Fatal(err)
+	}
+	if from != want || to != want {
+		t.Errorf("time params = %s .. %s, want %s", from, to, want)
+	}
+
+	ref, err := parseRevisionRef("2024-05-01T15:30:00+03:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.at != want {
+		t.Errorf("revision ref at = %s, want %s", ref.at, want)
+	}
+}
@@ -0,0 +1,259 @@
+package api
+
+import (
+	"biocad-tsv-service/internal/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type UnitListResponse struct {
+	Page  int                  `json:"page"`
+	Limit int                  `json:"limit"`
+	Total int                  `json:"total"`
+	Data  []models.UnitSummary `json:"data"`
+}
+
+type RevisionListResponse struct {
+	Page  int                   `json:"page"`
+	Limit int                   `json:"limit"`
+	Total int                   `json:"total"`
+	Data  []models.UnitRevision `json:"data"`
+}
+
+// UnitDefinitionResponse is the definition of a unit at one revision
+type UnitDefinitionResponse struct {
+	Revision models.UnitRevision     `json:"revision"`
+	Data     []models.MessageVersion `json:"data"`
+}
+
+// revisionRef selects a revision of a unit: by number, as of a time, or the latest one when both are zero
+type revisionRef struct {
+	number int
+	at     time.Time
+}
+
+// handleListUnits handles GET /units?page=...&limit=..., the units that have messages with their statistics
+func (s *Server) handleListUnits(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	page, limit := pageParams(r.URL.Query())
+
+	total, err := s.MsgRepo.CountUnits(ctx)
+	if err != nil {
+		http.Error(w, "failed to count units", http.StatusInternalServerError)
+		return
+	}
+
+	units, err := s.MsgRepo.ListUnits(ctx, limit, (page-1)*limit)
+	if err != nil {
+		http.Error(w, "failed to query units", http.StatusInternalServerError)
+		return
+	}
+
+	resp := UnitListResponse{
+		Page:  page,
+		Limit: limit,
+		Total: total,
+		Data:  units,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// handleGetUnit handles GET /units/{guid}, the statistics of one unit
+func (s *Server) handleGetUnit(w http.ResponseWriter, r *http.Request) {
+	unitGUID, err := uuid.Parse(r.PathValue("guid"))
+	if err != nil {
+		http.Error(w, "invalid unit_guid", http.StatusBadRequest)
+		return
+	}
+
+	unit, err := s.MsgRepo.GetUnit(r.Context(), unitGUID)
+	if err != nil {
+		http.Error(w, "failed to query unit", http.StatusInternalServerError)
+		return
+	}
+	if unit == nil {
+		http.Error(w, "unit not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(unit)
+}
+
+// handleListRevisions handles GET /units/{guid}/revisions?page=...&limit=..., newest first
+func (s *Server) handleListRevisions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	unitGUID, err := uuid.Parse(r.PathValue("guid"))
+	if err != nil {
+		http.Error(w, "invalid unit_guid", http.StatusBadRequest)
+		return
+	}
+	page, limit := pageParams(r.URL.Query())
+
+	total, err := s.RevRepo.Count(ctx, unitGUID)
+	if err != nil {
+		http.Error(w, "failed to count revisions", http.StatusInternalServerError)
+		return
+	}
+
+	revisions, err := s.RevRepo.List(ctx, unitGUID, limit, (page-1)*limit)
+	if err != nil {
+		http.Error(w, "failed to query revisions", http.StatusInternalServerError)
+		return
+	}
+
+	resp := RevisionListResponse{
+		Page:  page,
+		Limit: limit,
+		Total: total,
+		Data:  revisions,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// handleGetDefinition handles GET /units/{guid}/definition?revision=...|at=...,
+// the messages of the unit as they were at a revision or a time, the latest ones without parameters
+func (s *Server) handleGetDefinition(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	unitGUID, err := uuid.Parse(r.PathValue("guid"))
+	if err != nil {
+		http.Error(w, "invalid unit_guid", http.StatusBadRequest)
+		return
+	}
+
+	var ref revisionRef
+	if v := query.Get("revision"); v != "" {
+		if ref.number, err = strconv.Atoi(v); err != nil || ref.number < 1 {
+			http.Error(w, "invalid revision", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("at"); v != "" {
+		if ref.number != 0 {
+			http.Error(w, "revision and at can't be used together", http.StatusBadRequest)
+			return
+		}
+		if ref.at, err = parseTime(v); err != nil {
+			http.Error(w, "invalid at, expected RFC 3339 time or YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rev, err := s.findRevision(ctx, unitGUID, ref)
+	if err != nil {
+		http.Error(w, "failed to query revision", http.StatusInternalServerError)
+		return
+	}
+	if rev == nil {
+		http.Error(w, "revision not found", http.StatusNotFound)
+		return
+	}
+
+	versions, err := s.RevRepo.Versions(ctx, unitGUID, rev.Revision)
+	if err != nil {
+		http.Error(w, "failed to query message versions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(UnitDefinitionResponse{Revision: *rev, Data: versions})
+}
+
+// handleGetDiff handles GET /units/{guid}/diff?from=...&to=..., the messages added, removed and modified
+// between two revisions of the unit. Each of from and to is a revision number or a time; to defaults to
+// the latest revision and from to the one before to.
+func (s *Server) handleGetDiff(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	unitGUID, err := uuid.Parse(r.PathValue("guid"))
+	if err != nil {
+		http.Error(w, "invalid unit_guid", http.StatusBadRequest)
+		return
+	}
+
+	var fromRef, toRef revisionRef
+	for _, p := range []struct {
+		name string
+		ref  *revisionRef
+	}{{"from", &fromRef}, {"to", &toRef}} {
+		if v := query.Get(p.name); v != "" {
+			if *p.ref, err = parseRevisionRef(v); err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s: %v", p.name, err), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	to, err := s.findRevision(ctx, unitGUID, toRef)
+	if err != nil {
+		http.Error(w, "failed to query revision", http.StatusInternalServerError)
+		return
+	}
+	if to == nil {
+		http.Error(w, "revision to not found", http.StatusNotFound)
+		return
+	}
+
+	// without from the revision before to, none for the first one
+	var from *models.UnitRevision
+	if fromRef != (revisionRef{}) || to.Revision > 1 {
+		if fromRef == (revisionRef{}) {
+			fromRef.number = to.Revision - 1
+		}
+		if from, err = s.findRevision(ctx, unitGUID, fromRef); err != nil {
+			http.Error(w, "failed to query revision", http.StatusInternalServerError)
+			return
+		}
+		if from == nil {
+			http.Error(w, "revision from not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	diff, err := s.RevRepo.Diff(ctx, unitGUID, from, to, s.NaturalKey)
+	if err != nil {
+		http.Error(w, "failed to compare revisions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(diff)
+}
+
+// parseRevisionRef reads a revision number or a time
+func parseRevisionRef(v string) (revisionRef, error) {
+	if n, err := strconv.Atoi(v); err == nil {
+		if n < 1 {
+			return revisionRef{}, errors.New("revisions start at 1")
+		}
+		return revisionRef{number: n}, nil
+	}
+	at, err := parseTime(v)
+	if err != nil {
+		return revisionRef{}, errors.New("expected a revision number, RFC 3339 time or YYYY-MM-DD")
+	}
+	return revisionRef{at: at}, nil
+}
+
+// findRevision looks up the revision of the unit the ref selects, nil if there is none
+func (s *Server) findRevision(ctx context.Context, unitGUID uuid.UUID, ref revisionRef) (*models.UnitRevision, error) {
+	switch {
+	case ref.number != 0:
+		return s.RevRepo.Get(ctx, unitGUID, ref.number)
+	case !ref.at.IsZero():
+		return s.RevRepo.AsOf(ctx, unitGUID, ref.at)
+	default:
+		return s.RevRepo.Latest(ctx, unitGUID)
+	}
+}
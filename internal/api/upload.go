@@ -0,0 +1,244 @@
+package api
+
+import (
+	"biocad-tsv-service/internal/models"
+	"biocad-tsv-service/internal/queue"
+	"biocad-tsv-service/internal/util"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// upload job statuses, what the processed file status means for the client that uploaded it
+const (
+	uploadStatusQueued  = "queued"  // waiting for a worker, also between retries
+	uploadStatusParsing = "parsing" // a worker is ingesting it
+	uploadStatusDone    = "done"    // ingested, possibly with parse errors counted in error_count
+	uploadStatusFailed  = "failed"  // the ingest failed too many times
+)
+
+// UploadJob is the ingest of an uploaded file, polled with GET /jobs/{id}
+type UploadJob struct {
+	ID           uuid.UUID `json:"id"`          // the processed_files id, also accepted by the /files endpoints
+	Status       string    `json:"status"`      // queued / parsing / done / failed
+	FileStatus   string    `json:"file_status"` // the detailed processed_files status
+	RowCount     int       `json:"row_count"`
+	MessageCount int       `json:"message_count"`
+	ErrorCount   int       `json:"error_count"`
+	LastError    *string   `json:"last_error"`
+}
+
+// uploadJob describes the ingest of the file as an upload job
+func uploadJob(f *models.ProcessedFile) UploadJob {
+	status := uploadStatusDone // success, failed and purged: the ingest ran to the end
+	switch f.Status {
+	case models.FileStatusQueued, models.FileStatusRetry:
+		status = uploadStatusQueued
+	case models.FileStatusParsing:
+		status = uploadStatusParsing
+	case models.FileStatusDead:
+		status = uploadStatusFailed
+	}
+	return UploadJob{
+		ID:           f.ID,
+		Status:       status,
+		FileStatus:   f.Status,
+		RowCount:     f.RowCount,
+		MessageCount: f.MessageCount,
+		ErrorCount:   f.ErrorCount,
+		LastError:    f.LastError,
+	}
+}
+
+// errUnsupportedUpload is returned for a request that carries no file in a supported form
+var errUnsupportedUpload = errors.New("expected multipart/form-data with a \"file\" field or a text/tab-separated-values body")
+
+// handleUploadFile handles POST /files with a TSV file as multipart/form-data (field "file")
+// or as the raw body (text/tab-separated-values, the name may be given with ?filename=).
+// The file is written into the input directory and ingested like any other file there.
+// The response is the upload job, polled with GET /jobs/{id}.
+// Content that is known already is not written again, the job of its existing row is returned with 200.
+func (s *Server) handleUploadFile(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.MaxUploadSize)
+
+	var file *models.ProcessedFile
+	var created bool
+	body, name, err := uploadedFile(r)
+	if err == nil {
+		file, created, err = s.saveUpload(r.Context(), body, name)
+	}
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("file is larger than %d bytes", s.MaxUploadSize), http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, errUnsupportedUpload):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	case errors.Is(err, errEmptyUpload):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("[api] failed to save uploaded file %q: %v", name, err)
+		http.Error(w, "failed to save file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+file.ID.String())
+	if created {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	_ = json.NewEncoder(w).Encode(uploadJob(file))
+}
+
+// handleGetJob handles GET /jobs/{id}, the status of an upload job
+func (s *Server) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid job id", http.StatusBadRequest)
+		return
+	}
+
+	file, err := s.PFRepo.GetByID(r.Context(), id)
+	if err != nil {
+		http.Error(w, "failed to query job", http.StatusInternalServerError)
+		return
+	}
+	if file == nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(uploadJob(file))
+}
+
+// uploadedFile returns the file content of the request and the name the client gave it
+func uploadedFile(r *http.Request) (io.Reader, string, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "multipart/form-data":
+		mr, err := r.MultipartReader()
+		if err != nil {
+			return nil, "", errUnsupportedUpload
+		}
+		for {
+			part, err := mr.NextPart()
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return nil, "", err
+			}
+			if err != nil {
+				return nil, "", errUnsupportedUpload
+			}
+			if part.FormName() == "file" {
+				return part, part.FileName(), nil
+			}
+		}
+	case "", "text/tab-separated-values", "text/plain", "application/octet-stream":
+		return r.Body, r.URL.Query().Get("filename"), nil
+	default:
+		return nil, "", errUnsupportedUpload
+	}
+}
+
+// errEmptyUpload is returned for an upload without content
+var errEmptyUpload = errors.New("file is empty")
+
+// saveUpload writes the upload into the input directory. The content is written to a temporary
+// file the scanner ignores and renamed to a .tsv file with a done marker once complete, so it is
+// never picked up half-written. It reports whether the content is new.
+func (s *Server) saveUpload(ctx context.Context, src io.Reader, name string) (*models.ProcessedFile, bool, error) {
+	tmp, err := os.CreateTemp(s.InputDir, ".upload-*.tmp")
+	if err != nil {
+		return nil, false, err
+	}
+	tmpName := tmp.Name()
+	keep := false
+	defer func() {
+		_ = tmp.Close()
+		if !keep {
+			_ = os.Remove(tmpName)
+		}
+	}()
+
+	hash, err := util.HashReader(io.TeeReader(src, tmp))
+	if err != nil {
+		return nil, false, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return nil, false, err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if info.Size() == 0 {
+		return nil, false, errEmptyUpload
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, false, err
+	}
+
+	// the same content is ingested or waiting already
+	existing, err := s.PFRepo.GetByHash(ctx, hash)
+	if err != nil {
+		return nil, false, err
+	}
+	if existing != nil {
+		return existing, false, nil
+	}
+
+	path := filepath.Join(s.InputDir, uploadName(name, hash))
+	if err := os.WriteFile(path+queue.DoneSuffix, nil, 0o644); err != nil {
+		return nil, false, err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		_ = os.Remove(path + queue.DoneSuffix)
+		return nil, false, err
+	}
+	keep = true
+
+	file, err := s.PFRepo.InsertQueued(ctx, &models.ProcessedFile{
+		Filename:    path,
+		ContentHash: hash,
+		Size:        info.Size(),
+		MTime:       info.ModTime(),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return file, true, nil
+}
+
+// uploadName makes the name of an uploaded file in the input directory from the client's name
+// and the content hash, so uploads with the same name don't replace each other
+func uploadName(name, hash string) string {
+	stem := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+	stem = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, stem)
+	stem = strings.Trim(stem, "_")
+	if runes := []rune(stem); len(runes) > 100 {
+		stem = string(runes[:100])
+	}
+	if stem == "" {
+		stem = "upload"
+	}
+	return fmt.Sprintf("%s.%s.tsv", stem, hash[:12])
+}
@@ -0,0 +1,202 @@
+package archive
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Archiver moves processed files out of the input directory
+type Archiver struct {
+	SuccessDir    string // destination of files processed without errors, empty keeps them in place
+	FailedDir     string // destination of files processed with errors, empty keeps them in place
+	DatePartition bool   // store files in YYYY/MM/DD subfolders
+	Compress      bool   // gzip files, adding the .gz extension
+}
+
+// New creates a new Archiver
+func New(successDir, failedDir string, datePartition, compress bool) *Archiver {
+	return &Archiver{
+		SuccessDir:    successDir,
+		FailedDir:     failedDir,
+		DatePartition: datePartition,
+		Compress:      compress,
+	}
+}
+
+// Move moves the file into the directory for its processing result and returns its new path.
+// When no directory is configured for the result the file stays where it is and its path is returned.
+func (a *Archiver) Move(path string, failed bool) (string, error) {
+	dir := a.SuccessDir
+	if failed {
+		dir = a.FailedDir
+	}
+	if dir == "" {
+		return path, nil
+	}
+
+	if a.DatePartition {
+		dir = filepath.Join(dir, time.Now().Format("2006/01/02"))
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+
+	name := filepath.Base(path)
+	if a.Compress {
+		name += ".gz"
+	}
+	dst := uniquePath(filepath.Join(dir, name))
+
+	var err error
+	if a.Compress {
+		err = compressFile(path, dst)
+	} else {
+		err = moveFile(path, dst)
+	}
+	if err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// Restore moves an archived file back into dir, decompressing it if it was gzipped, and returns its new path.
+// A file that is in dir already is left as it is.
+func (a *Archiver) Restore(path, dir string) (string, error) {
+	if filepath.Clean(filepath.Dir(path)) == filepath.Clean(dir) {
+		return path, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+
+	name := filepath.Base(path)
+	compressed := strings.HasSuffix(name, ".gz")
+	dst := uniquePath(filepath.Join(dir, strings.TrimSuffix(name, ".gz")))
+
+	var err error
+	if compressed {
+		err = decompressFile(path, dst)
+	} else {
+		err = moveFile(path, dst)
+	}
+	if err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// uniquePath returns path, or path with a timestamp before the extension if it is taken,
+// so an archived file with the same name is never overwritten
+func uniquePath(path string) string {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return path
+	}
+
+	dir, name := filepath.Split(path)
+	ext := ""
+	for _, e := range []string{".tsv.gz", ".tsv", ".gz"} {
+		if strings.HasSuffix(name, e) {
+			ext = e
+			break
+		}
+	}
+	base := strings.TrimSuffix(name, ext)
+	return filepath.Join(dir, fmt.Sprintf("%s-%s%s", base, time.Now().Format("20060102T150405.000000000"), ext))
+}
+
+// moveFile renames src to dst, copying when they are on different filesystems
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return fmt.Errorf("failed to move %s to %s: %w", src, dst, err)
+	}
+
+	if err := writeAtomically(src, dst, func(w io.Writer, r io.Reader) error {
+		_, err := io.Copy(w, r)
+		return err
+	}); err != nil {
+		return err
+	}
+	return removeSource(src)
+}
+
+// compressFile writes src gzipped to dst and removes src
+func compressFile(src, dst string) error {
+	if err := writeAtomically(src, dst, func(w io.Writer, r io.Reader) error {
+		zw := gzip.NewWriter(w)
+		zw.Name = filepath.Base(src)
+		if _, err := io.Copy(zw, r); err != nil {
+			return err
+		}
+		return zw.Close()
+	}); err != nil {
+		return err
+	}
+	return removeSource(src)
+}
+
+// decompressFile writes the gzipped src unpacked to dst and removes src
+func decompressFile(src, dst string) error {
+	if err := writeAtomically(src, dst, func(w io.Writer, r io.Reader) error {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, zr); err != nil {
+			return err
+		}
+		return zr.Close()
+	}); err != nil {
+		return err
+	}
+	return removeSource(src)
+}
+
+// writeAtomically copies src through write into a temporary file next to dst and renames it to dst,
+// so dst never exists half written
+func writeAtomically(src, dst string, write func(w io.Writer, r io.Reader) error) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+	if err := write(out, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to close %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to rename %s to %s: %w", tmp, dst, err)
+	}
+	return nil
+}
+
+func removeSource(src string) error {
+	if err := os.Remove(src); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", src, err)
+	}
+	return nil
+}
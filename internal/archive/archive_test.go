@@ -0,0 +1,248 @@
+package archive
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+const content = "unit_guid\tlevel\n11111111-1111-1111-1111-111111111111\t2\n"
+
+// writeFile creates a file with content and returns its path
+func writeFile(t *testing.T, path, data string) string {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readFile returns the content of the file, unpacked if it is gzipped
+func readFile(t *testing.T, path string, gzipped bool) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var r io.Reader = f
+	if gzipped {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func assertMissing(t *testing.T, path string) {
+	t.Helper()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("%s still exists", path)
+	}
+}
+
+func TestUniquePath(t *testing.T) {
+	dir := t.TempDir()
+	stamped := `-\d{8}T\d{6}\.\d{9}`
+	tests := []struct {
+		name  string
+		taken bool
+		want  string // pattern of the base name
+	}{
+		{name: "free.tsv", want: `^free\.tsv$`},
+		{name: "data.tsv", taken: true, want: `^data` + stamped + `\.tsv$`},
+		{name: "data.tsv.gz", taken: true, want: `^data` + stamped + `\.tsv\.gz$`},
+		{name: "data.gz", taken: true, want: `^data` + stamped + `\.gz$`},
+		{name: "notes", taken: true, want: `^notes` + stamped + `$`},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		if tt.taken {
+			writeFile(t, path, "")
+		}
+		got := uniquePath(path)
+		if filepath.Dir(got) != dir {
+			t.Errorf("uniquePath(%s) = %s, not in the same directory", tt.name, got)
+		}
+		if !regexp.MustCompile(tt.want).MatchString(filepath.Base(got)) {
+			t.Errorf("uniquePath(%s) = %s, want %s", tt.name, filepath.Base(got), tt.want)
+		}
+	}
+}
+
+func TestMove(t *testing.T) {
+	tests := []struct {
+		name      string
+		archiver  *Archiver
+		failed    bool
+		wantDir   string // relative to the test directory, empty keeps the file in input
+		partition bool
+		gzipped   bool
+	}{
+		{name: "success", archiver: New("archive", "failed", false, false), wantDir: "archive"},
+		{name: "failed", archiver: New("archive", "failed", false, false), failed: true, wantDir: "failed"},
+		{name: "no directory", archiver: New("", "", false, false)},
+		{name: "date partition", archiver: New("archive", "", true, false), wantDir: "archive", partition: true},
+		{name: "compressed", archiver: New("", "failed", false, true), failed: true, wantDir: "failed", gzipped: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if tt.archiver.SuccessDir != "" {
+				tt.archiver.SuccessDir = filepath.Join(root, tt.archiver.SuccessDir)
+			}
+			if tt.archiver.FailedDir != "" {
+				tt.archiver.FailedDir = filepath.Join(root, tt.archiver.FailedDir)
+			}
+			src := writeFile(t, filepath.Join(root, "input", "data.tsv"), content)
+
+			dst, err := tt.archiver.Move(src, tt.failed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.wantDir == "" {
+				if dst != src {
+					t.Errorf("file moved to %s, want it kept at %s", dst, src)
+				}
+				return
+			}
+			wantDir := filepath.Join(root, tt.wantDir)
+			if tt.partition {
+				wantDir = filepath.Join(wantDir, time.Now().Format("2006/01/02"))
+			}
+			wantName := "data.tsv"
+			if tt.gzipped {
+				wantName += ".gz"
+			}
+			if want := filepath.Join(wantDir, wantName); dst != want {
+				t.Errorf("file moved to %s, want %s", dst, want)
+			}
+			assertMissing(t, src)
+			assertMissing(t, dst+".tmp")
+			if got := readFile(t, dst, tt.gzipped); got != content {
+				t.Errorf("moved file has content %q", got)
+			}
+		})
+	}
+}
+
+func TestMoveKeepsArchivedFile(t *testing.T) {
+	root := t.TempDir()
+	a := New(filepath.Join(root, "archive"), "", false, false)
+	first := writeFile(t, filepath.Join(root, "archive", "data.tsv"), "first")
+	src := writeFile(t, filepath.Join(root, "input", "data.tsv"), content)
+
+	dst, err := a.Move(src, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst == first {
+		t.Fatal("archived file with the same name was overwritten")
+	}
+	if readFile(t, first, false) != "first" || readFile(t, dst, false) != content {
+		t.Error("files mixed up")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	tests := []struct {
+		name     string
+		archived string // relative to the test directory
+		gzipped  bool
+		want     string // relative to the test directory
+	}{
+		{name: "plain", archived: "archive/2024/05/01/data.tsv", want: "input/data.tsv"},
+		{name: "gzipped", archived: "failed/data.tsv.gz", gzipped: true, want: "input/data.tsv"},
+		{name: "already in input", archived: "input/data.tsv", want: "input/data.tsv"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			src := filepath.Join(root, tt.archived)
+			if tt.gzipped {
+				if err := os.MkdirAll(filepath.Dir(src), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				f, err := os.Create(src)
+				if err != nil {
+					t.Fatal(err)
+				}
+				zw := gzip.NewWriter(f)
+				if _, err := zw.Write([]byte(content)); err != nil {
+					t.Fatal(err)
+				}
+				if err := zw.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if err := f.Close(); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				writeFile(t, src, content)
+			}
+
+			dst, err := New("", "", false, false).Restore(src, filepath.Join(root, "input"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(root, tt.want); dst != want {
+				t.Errorf("restored to %s, want %s", dst, want)
+			}
+			if dst != src {
+				assertMissing(t, src)
+			}
+			if got := readFile(t, dst, false); got != content {
+				t.Errorf("restored file has content %q", got)
+			}
+		})
+	}
+}
+
+func TestRestoreKeepsInputFile(t *testing.T) {
+	root := t.TempDir()
+	existing := writeFile(t, filepath.Join(root, "input", "data.tsv"), "newer upload")
+	src := writeFile(t, filepath.Join(root, "archive", "data.tsv"), content)
+
+	dst, err := New("", "", false, false).Restore(src, filepath.Join(root, "input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst == existing || readFile(t, existing, false) != "newer upload" {
+		t.Fatal("file in the input directory was overwritten")
+	}
+	if readFile(t, dst, false) != content {
+		t.Error("restored file has the wrong content")
+	}
+}
+
+func TestRestoreBrokenArchive(t *testing.T) {
+	root := t.TempDir()
+	src := writeFile(t, filepath.Join(root, "failed", "data.tsv.gz"), "not gzip")
+
+	if _, err := New("", "", false, false).Restore(src, filepath.Join(root, "input")); err == nil {
+		t.Fatal("want an error for a broken archive")
+	}
+	// nothing half written is left in input, the archive stays
+	assertMissing(t, filepath.Join(root, "input", "data.tsv"))
+	assertMissing(t, filepath.Join(root, "input", "data.tsv.tmp"))
+	if readFile(t, src, false) != "not gzip" {
+		t.Error("broken archive was removed")
+	}
+}
@@ -4,51 +4,347 @@ import (
 	"fmt"
 	"gopkg.in/yaml.v3"
 	"os"
+	"time"
 )
 
+// DefaultMaxUploadSize limits files uploaded through the API when server.max_upload_size is not set
+const DefaultMaxUploadSize = 64 << 20
+
 type ServerConfig struct {
-	Port string `yaml:"port"`
+	Port          string `yaml:"port"`
+	MaxUploadSize int64  `yaml:"max_upload_size"` // bytes
 }
 
+// ssl modes of the postgres connection
+const (
+	SSLModeDisable    = "disable"
+	SSLModeAllow      = "allow"
+	SSLModePrefer     = "prefer"
+	SSLModeRequire    = "require"
+	SSLModeVerifyCA   = "verify-ca"
+	SSLModeVerifyFull = "verify-full"
+)
+
+// DefaultApplicationName identifies the service's connections in pg_stat_activity
+const DefaultApplicationName = "biocad-tsv-service"
+
 type DBConfig struct {
+	// DSN is a complete connection string, when set the connection fields below are ignored
+	// and only the pool settings are applied on top of it
+	DSN      string `yaml:"dsn"`
 	Host     string `yaml:"host"`
 	Port     int    `yaml:"port"`
 	User     string `yaml:"user"`
 	Password string `yaml:"password"`
 	Name     string `yaml:"name"`
+
+	SSLMode     string `yaml:"sslmode"`     // disable / allow / prefer / require / verify-ca / verify-full
+	SSLRootCert string `yaml:"sslrootcert"` // CA certificate the server certificate is verified with
+	SSLCert     string `yaml:"sslcert"`     // client certificate
+	SSLKey      string `yaml:"sslkey"`      // key of the client certificate
+
+	MaxConns         int           `yaml:"max_conns"`          // pool size, 0 keeps the pgx default
+	MinConns         int           `yaml:"min_conns"`          // connections kept open while idle
+	MaxConnLifetime  time.Duration `yaml:"max_conn_lifetime"`  // a connection is closed after this long
+	MaxConnIdleTime  time.Duration `yaml:"max_conn_idle_time"` // an idle connection is closed after this long
+	StatementTimeout time.Duration `yaml:"statement_timeout"`  // server side limit of a single statement, 0 disables
+	ApplicationName  string        `yaml:"application_name"`
+
+	AutoMigrate bool `yaml:"auto_migrate"` // apply pending schema migrations at startup
 }
 
 type DirConfig struct {
-	Input  string `yaml:"input"`
-	Output string `yaml:"output"`
+	Input   string `yaml:"input"`
+	Output  string `yaml:"output"`
+	Archive string `yaml:"archive"` // processed files are moved here, empty keeps them in input
+	Failed  string `yaml:"failed"`  // files with parse errors are moved here, empty keeps them in input
+}
+
+type ArchiveConfig struct {
+	DatePartition bool `yaml:"date_partition"` // YYYY/MM/DD subfolders
+	Compress      bool `yaml:"compress"`       // gzip archived files
+}
+
+// ingest modes
+const (
+	IngestModePartial = "partial" // keep the valid rows of a file, record the broken ones
+	IngestModeStrict  = "strict"  // keep nothing but the parse errors if any row of a file fails
+)
+
+// ingest write modes
+const (
+	IngestWriteAppend = "append" // every file adds all of its messages
+	IngestWriteUpsert = "upsert" // messages with the natural key of a stored one update it
+)
+
+// DefaultBatchSize is the number of messages written per COPY when ingest.batch_size is not set
+const DefaultBatchSize = 1000
+
+// DefaultNaturalKey identifies a message of a unit in upsert mode when ingest.natural_key is not set
+var DefaultNaturalKey = []string{"unit_guid", "msg_id"}
+
+type IngestConfig struct {
+	Mode      string `yaml:"mode"`
+	BatchSize int    `yaml:"batch_size"`
+
+	Write         string   `yaml:"write"`          // append | upsert
+	NaturalKey    []string `yaml:"natural_key"`    // message columns identifying a message of a unit
+	DeleteMissing bool     `yaml:"delete_missing"` // upsert: delete messages of the file's units it doesn't contain
+}
+
+// scanner modes
+const (
+	ScannerModePoll    = "poll"    // list the input directory periodically
+	ScannerModeInotify = "inotify" // react to inotify events, linux only
+)
+
+// defaults of the scanner
+const (
+	DefaultScanInterval   = 30 * time.Second // how often the input directory is listed in poll mode
+	DefaultRescanInterval = 5 * time.Minute  // how often the inotify watcher rescans the whole input directory
+)
+
+type ScannerConfig struct {
+	Mode              string        `yaml:"mode"`
+	Interval          time.Duration `yaml:"interval"`            // listing interval in poll mode
+	RescanInterval    time.Duration `yaml:"rescan_interval"`     // safety rescans in inotify mode
+	QuietPeriod       time.Duration `yaml:"quiet_period"`        // size and mtime must not change this long, 0 disables
+	RequireDoneMarker bool          `yaml:"require_done_marker"` // queue only files with a .done sidecar
+}
+
+// queue backends
+const (
+	QueueBackendMemory   = "memory"   // in-process queue, jobs are lost on restart
+	QueueBackendPostgres = "postgres" // jobs table shared by all instances
+)
+
+// defaults of the queue
+const (
+	DefaultQueueSize       = 100
+	DefaultJobLease        = time.Minute
+	DefaultJobPollInterval = 2 * time.Second
+	DefaultJobRetention    = 7 * 24 * time.Hour
+)
+
+type QueueConfig struct {
+	Backend      string        `yaml:"backend"`
+	Size         int           `yaml:"size"`          // capacity of the memory queue
+	Lease        time.Duration `yaml:"lease"`         // a claimed job returns to the queue if not renewed for this long
+	PollInterval time.Duration `yaml:"poll_interval"` // how often idle workers look for jobs
+	Retention    time.Duration `yaml:"retention"`     // done and failed jobs are deleted after this long
+}
+
+// defaults of failed file retries
+const (
+	DefaultRetryMaxAttempts = 5
+	DefaultRetryBackoff     = 30 * time.Second
+	DefaultRetryMaxBackoff  = time.Hour
+)
+
+// RetryConfig controls how files whose ingest failed are retried
+type RetryConfig struct {
+	MaxAttempts int           `yaml:"max_attempts"` // the file is marked dead after this many failed attempts
+	Backoff     time.Duration `yaml:"backoff"`      // delay after the first failure, doubled after every next one
+	MaxBackoff  time.Duration `yaml:"max_backoff"`  // upper bound of the delay
+}
+
+// DefaultWorkers is the number of files processed concurrently when workers.count is not set
+const DefaultWorkers = 4
+
+// MaxWorkers bounds workers.count, every worker may hold a database connection
+const MaxWorkers = 256
+
+type WorkerConfig struct {
+	Count int `yaml:"count"`
+}
+
+// RangeRule limits an integer field, either bound may be omitted
+type RangeRule struct {
+	Min *int `yaml:"min"`
+	Max *int `yaml:"max"`
+}
+
+// ValidationConfig holds the rules every message row must satisfy.
+// Fields are referred to by their TSV column names (unit_guid, class, area, bit, ...).
+type ValidationConfig struct {
+	RulesFile  string               `yaml:"rules_file"`  // YAML file with the rules, replaces the inline ones
+	Required   []string             `yaml:"required"`    // fields that must not be empty
+	Enums      map[string][]string  `yaml:"enums"`       // allowed values of a field
+	IgnoreCase bool                 `yaml:"ignore_case"` // compare enum values case-insensitively
+	Ranges     map[string]RangeRule `yaml:"ranges"`      // integer bounds of a field
+	Patterns   map[string]string    `yaml:"patterns"`    // regular expressions a field must match
 }
 
 type Config struct {
-	Server ServerConfig `yaml:"server"`
-	DB     DBConfig     `yaml:"db"`
-	Dirs   DirConfig    `yaml:"dirs"`
+	Server     ServerConfig     `yaml:"server"`
+	DB         DBConfig         `yaml:"db"`
+	Dirs       DirConfig        `yaml:"dirs"`
+	Archive    ArchiveConfig    `yaml:"archive"`
+	Scanner    ScannerConfig    `yaml:"scanner"`
+	Queue      QueueConfig      `yaml:"queue"`
+	Workers    WorkerConfig     `yaml:"workers"`
+	Ingest     IngestConfig     `yaml:"ingest"`
+	Retry      RetryConfig      `yaml:"retry"`
+	Validation ValidationConfig `yaml:"validation"`
 }
 
-// LoadConfig reads the YAML file and returns Config
-func LoadConfig(path string) (*Config, error) {
+// DefaultPath is the config file read when no other is given
+const DefaultPath = "config.yaml"
+
+// Load builds the config in layers, each one overriding the previous:
+// defaults, the YAML file, TSV_* environment variables and command-line flags.
+// The file is given by the -config flag or TSV_CONFIG, a missing default file is skipped.
+// The arguments left after the flags are returned, they name a command to run.
+func Load(args []string) (*Config, []string, error) {
+	var cfg Config
+	var configPath string
+	flags := make(map[string]string)
+	fields := cfg.fields()
+
+	fs := flagSet(fields, flags, &configPath)
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if configPath == "" {
+		configPath = os.Getenv(EnvPrefix + "CONFIG")
+	}
+	if configPath == "" {
+		if _, err := os.Stat(DefaultPath); err == nil {
+			configPath = DefaultPath
+		}
+	}
+	if configPath != "" {
+		if err := cfg.loadFile(configPath); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, nil, err
+	}
+	for _, f := range fields {
+		if raw, ok := flags[f.key]; ok {
+			if err := f.set(raw); err != nil {
+				return nil, nil, fmt.Errorf("flag -%s: %w", f.key, err)
+			}
+		}
+	}
+
+	if cfg.Validation.RulesFile != "" {
+		rules, err := loadRules(cfg.Validation.RulesFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg.Validation = *rules
+	}
+
+	cfg.applyDefaults()
+	return &cfg, fs.Args(), nil
+}
+
+// loadFile reads the YAML file over the current values
+func (c *Config) loadFile(path string) error {
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+		return fmt.Errorf("failed to read config file: %w", err)
 	}
 
-	var cfg Config
-	err = yaml.Unmarshal(data, &cfg)
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+	return nil
+}
+
+// loadRules reads validation rules from a separate YAML file
+func loadRules(path string) (*ValidationConfig, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
+		return nil, fmt.Errorf("failed to read rules file: %w", err)
 	}
 
-	return &cfg, nil
+	var rules ValidationConfig
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse rules file: %w", err)
+	}
+	rules.RulesFile = path
+	return &rules, nil
+}
+
+// applyDefaults fills optional fields that are not set in the file
+func (c *Config) applyDefaults() {
+	if c.Server.MaxUploadSize == 0 {
+		c.Server.MaxUploadSize = DefaultMaxUploadSize
+	}
+	if c.DB.SSLMode == "" {
+		c.DB.SSLMode = SSLModeDisable
+	}
+	if c.DB.ApplicationName == "" {
+		c.DB.ApplicationName = DefaultApplicationName
+	}
+	if c.Scanner.Mode == "" {
+		c.Scanner.Mode = ScannerModePoll
+	}
+	if c.Scanner.Interval == 0 {
+		c.Scanner.Interval = DefaultScanInterval
+	}
+	if c.Scanner.RescanInterval == 0 {
+		c.Scanner.RescanInterval = DefaultRescanInterval
+	}
+	if c.Queue.Backend == "" {
+		c.Queue.Backend = QueueBackendMemory
+	}
+	if c.Queue.Size == 0 {
+		c.Queue.Size = DefaultQueueSize
+	}
+	if c.Queue.Lease == 0 {
+		c.Queue.Lease = DefaultJobLease
+	}
+	if c.Queue.PollInterval == 0 {
+		c.Queue.PollInterval = DefaultJobPollInterval
+	}
+	if c.Queue.Retention == 0 {
+		c.Queue.Retention = DefaultJobRetention
+	}
+	if c.Workers.Count == 0 {
+		c.Workers.Count = DefaultWorkers
+	}
+	if c.Ingest.Mode == "" {
+		c.Ingest.Mode = IngestModePartial
+	}
+	if c.Ingest.BatchSize == 0 {
+		c.Ingest.BatchSize = DefaultBatchSize
+	}
+	if c.Ingest.Write == "" {
+		c.Ingest.Write = IngestWriteAppend
+	}
+	if len(c.Ingest.NaturalKey) == 0 {
+		c.Ingest.NaturalKey = append([]string(nil), DefaultNaturalKey...)
+	}
+	if c.Retry.MaxAttempts == 0 {
+		c.Retry.MaxAttempts = DefaultRetryMaxAttempts
+	}
+	if c.Retry.Backoff == 0 {
+		c.Retry.Backoff = DefaultRetryBackoff
+	}
+	if c.Retry.MaxBackoff == 0 {
+		c.Retry.MaxBackoff = DefaultRetryMaxBackoff
+	}
 }
 
 // String brings the config to a string for easy logging
 func (c *Config) String() string {
-	return fmt.Sprintf("Server{port=%s}, DB{host=%s, port=%d, user=%s}, Dirs{input=%s, output=%s}",
-		c.Server.Port, c.DB.Host, c.DB.Port, c.DB.User, c.Dirs.Input, c.Dirs.Output)
+	return fmt.Sprintf(
+		"Server{port=%s}, DB{host=%s, port=%d, user=%s, sslmode=%s, dsn=%t}, Dirs{input=%s, output=%s, archive=%s, failed=%s}, "+
+			"Scanner{mode=%s, interval=%s}, Queue{backend=%s, size=%d}, Workers{count=%d}, "+
+			"Ingest{mode=%s, batch_size=%d, write=%s, natural_key=%v, delete_missing=%t}, "+
+			"Retry{max_attempts=%d, backoff=%s, max_backoff=%s}",
+		c.Server.Port, c.DB.Host, c.DB.Port, c.DB.User, c.DB.SSLMode, c.DB.DSN != "",
+		c.Dirs.Input, c.Dirs.Output, c.Dirs.Archive, c.Dirs.Failed,
+		c.Scanner.Mode, c.Scanner.Interval, c.Queue.Backend, c.Queue.Size, c.Workers.Count,
+		c.Ingest.Mode, c.Ingest.BatchSize, c.Ingest.Write, c.Ingest.NaturalKey, c.Ingest.DeleteMissing,
+		c.Retry.MaxAttempts, c.Retry.Backoff, c.Retry.MaxBackoff,
+	)
 }
 
 // Validate checks if the config fields are valid
@@ -56,20 +352,11 @@ func (c *Config) Validate() error {
 	if c.Server.Port == "" {
 		return fmt.Errorf("server.port is required")
 	}
-	if c.DB.Host == "" {
-		return fmt.Errorf("db host is required")
-	}
-	if c.DB.Port <= 0 || c.DB.Port > 65535 {
-		return fmt.Errorf("db port must be between 1 and 65535")
-	}
-	if c.DB.User == "" {
-		return fmt.Errorf("db user is required")
+	if c.Server.MaxUploadSize < 1 {
+		return fmt.Errorf("server max_upload_size must be positive")
 	}
-	if c.DB.Password == "" {
-		return fmt.Errorf("db password is required")
-	}
-	if c.DB.Name == "" {
-		return fmt.Errorf("db name is required")
+	if err := c.DB.validate(); err != nil {
+		return err
 	}
 	if c.Dirs.Input == "" {
 		return fmt.Errorf("dirs input is required")
@@ -77,5 +364,105 @@ func (c *Config) Validate() error {
 	if c.Dirs.Output == "" {
 		return fmt.Errorf("dirs output is required")
 	}
+	if c.Scanner.Mode != ScannerModePoll && c.Scanner.Mode != ScannerModeInotify {
+		return fmt.Errorf("scanner mode must be %q or %q", ScannerModePoll, ScannerModeInotify)
+	}
+	if c.Scanner.Interval < time.Second {
+		return fmt.Errorf("scanner interval must be at least 1s")
+	}
+	if c.Scanner.RescanInterval < 0 {
+		return fmt.Errorf("scanner rescan_interval must be positive")
+	}
+	if c.Scanner.QuietPeriod < 0 {
+		return fmt.Errorf("scanner quiet_period must not be negative")
+	}
+	if c.Queue.Backend != QueueBackendMemory && c.Queue.Backend != QueueBackendPostgres {
+		return fmt.Errorf("queue backend must be %q or %q", QueueBackendMemory, QueueBackendPostgres)
+	}
+	if c.Queue.Size < 1 {
+		return fmt.Errorf("queue size must be positive")
+	}
+	if c.Queue.Lease < time.Second {
+		return fmt.Errorf("queue lease must be at least 1s")
+	}
+	if c.Queue.PollInterval <= 0 {
+		return fmt.Errorf("queue poll_interval must be positive")
+	}
+	if c.Queue.Retention <= 0 {
+		return fmt.Errorf("queue retention must be positive")
+	}
+	if c.Workers.Count < 1 || c.Workers.Count > MaxWorkers {
+		return fmt.Errorf("workers count must be between 1 and %d", MaxWorkers)
+	}
+	if c.Ingest.Mode != IngestModePartial && c.Ingest.Mode != IngestModeStrict {
+		return fmt.Errorf("ingest mode must be %q or %q", IngestModePartial, IngestModeStrict)
+	}
+	if c.Ingest.BatchSize < 1 {
+		return fmt.Errorf("ingest batch_size must be positive")
+	}
+	if c.Ingest.Write != IngestWriteAppend && c.Ingest.Write != IngestWriteUpsert {
+		return fmt.Errorf("ingest write must be %q or %q", IngestWriteAppend, IngestWriteUpsert)
+	}
+	if c.Retry.MaxAttempts < 1 {
+		return fmt.Errorf("retry max_attempts must be positive")
+	}
+	if c.Retry.Backoff <= 0 || c.Retry.MaxBackoff < c.Retry.Backoff {
+		return fmt.Errorf("retry backoff must be positive and not greater than max_backoff")
+	}
+	for field, r := range c.Validation.Ranges {
+		if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+			return fmt.Errorf("validation range of %s: min is greater than max", field)
+		}
+	}
+	return nil
+}
+
+// validate checks the connection settings, a raw DSN replaces the connection fields
+func (c *DBConfig) validate() error {
+	if c.DSN == "" {
+		if c.Host == "" {
+			return fmt.Errorf("db host is required")
+		}
+		if c.Port <= 0 || c.Port > 65535 {
+			return fmt.Errorf("db port must be between 1 and 65535")
+		}
+		if c.User == "" {
+			return fmt.Errorf("db user is required")
+		}
+		// a client certificate authenticates without a password
+		if c.Password == "" && c.SSLCert == "" {
+			return fmt.Errorf("db password is required")
+		}
+		if c.Name == "" {
+			return fmt.Errorf("db name is required")
+		}
+	}
+
+	switch c.SSLMode {
+	case SSLModeDisable, SSLModeAllow, SSLModePrefer, SSLModeRequire, SSLModeVerifyCA, SSLModeVerifyFull:
+	default:
+		return fmt.Errorf("db sslmode %q is not supported", c.SSLMode)
+	}
+	if (c.SSLCert == "") != (c.SSLKey == "") {
+		return fmt.Errorf("db sslcert and sslkey must be set together")
+	}
+	for _, path := range []string{c.SSLRootCert, c.SSLCert, c.SSLKey} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("db certificate file: %w", err)
+		}
+	}
+
+	if c.MaxConns < 0 || c.MinConns < 0 {
+		return fmt.Errorf("db max_conns and min_conns must not be negative")
+	}
+	if c.MaxConns > 0 && c.MinConns > c.MaxConns {
+		return fmt.Errorf("db min_conns must not be greater than max_conns")
+	}
+	if c.MaxConnLifetime < 0 || c.MaxConnIdleTime < 0 || c.StatementTimeout < 0 {
+		return fmt.Errorf("db max_conn_lifetime, max_conn_idle_time and statement_timeout must not be negative")
+	}
 	return nil
 }
@@ -0,0 +1,157 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix starts the names of the environment variables that override config fields:
+// db.host is TSV_DB_HOST, scanner.quiet_period is TSV_SCANNER_QUIET_PERIOD
+const EnvPrefix = "TSV_"
+
+// fileSuffix marks a variable holding the path of a file with the value, e.g. TSV_DB_PASSWORD_FILE,
+// for secrets mounted by Docker or Kubernetes
+const fileSuffix = "_FILE"
+
+// field is a config field that can be overridden, key is its YAML path such as db.host
+type field struct {
+	key   string
+	value reflect.Value
+}
+
+// envName returns the environment variable overriding the field
+func (f field) envName() string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(f.key, ".", "_"))
+}
+
+// fields lists the overridable fields of the config: the scalar and list fields of every section.
+// Maps such as the validation enums can only be set in the YAML file.
+func (c *Config) fields() []field {
+	var fields []field
+	sections := reflect.ValueOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		sectionKey := yamlName(sections.Type().Field(i))
+		if section.Kind() != reflect.Struct || sectionKey == "" {
+			continue
+		}
+		for j := 0; j < section.NumField(); j++ {
+			key := yamlName(section.Type().Field(j))
+			value := section.Field(j)
+			if key == "" || !settable(value) {
+				continue
+			}
+			fields = append(fields, field{key: sectionKey + "." + key, value: value})
+		}
+	}
+	return fields
+}
+
+func yamlName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+func settable(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64:
+		return true
+	case reflect.Slice:
+		return v.Type().Elem().Kind() == reflect.String
+	default:
+		return false
+	}
+}
+
+// set parses raw into the field
+func (f field) set(raw string) error {
+	v := f.value
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", raw)
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(raw)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int || v.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", raw)
+		}
+		v.SetInt(n)
+	case v.Kind() == reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	}
+	return nil
+}
+
+// applyEnv overrides the fields set in the environment. A field may also be read from
+// the file named by the variable with the _FILE suffix, setting both is an error.
+func (c *Config) applyEnv() error {
+	for _, f := range c.fields() {
+		name := f.envName()
+		raw, ok := os.LookupEnv(name)
+
+		if path, fromFile := os.LookupEnv(name + fileSuffix); fromFile {
+			if ok {
+				return fmt.Errorf("both %s and %s%s are set", name, name, fileSuffix)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("failed to read %s%s: %w", name, fileSuffix, err)
+			}
+			raw, ok = strings.TrimRight(string(data), "\r\n"), true
+		}
+
+		if !ok {
+			continue
+		}
+		if err := f.set(raw); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// flagSet declares a flag for every overridable field, named by its key: -db.host, -queue.backend.
+// The values are collected into flags and applied later, after the file and the environment.
+func flagSet(fields []field, flags map[string]string, configPath *string) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.StringVar(configPath, "config", "", "path of the YAML config file (env "+EnvPrefix+"CONFIG, default "+DefaultPath+")")
+	for _, f := range fields {
+		key := f.key
+		usage := "overrides " + key + " (env " + f.envName() + ")"
+		collect := func(raw string) error {
+			flags[key] = raw
+			return nil
+		}
+		if f.value.Kind() == reflect.Bool {
+			fs.BoolFunc(key, usage, collect)
+		} else {
+			fs.Func(key, usage, collect)
+		}
+	}
+	return fs
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile writes a file into the test's temporary directory and returns its path
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testYAML = `
+db:
+  host: file-host
+  port: 5433
+  password: file-password
+scanner:
+  interval: 10s
+workers:
+  count: 2
+ingest:
+  natural_key: [unit_guid, msg_id, addr]
+`
+
+func TestLoadLayers(t *testing.T) {
+	path := writeFile(t, "config.yaml", testYAML)
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		check func(t *testing.T, cfg *Config)
+	}{
+		{
+			name: "file over defaults",
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.DB.Host != "file-host" || cfg.DB.Port != 5433 || cfg.Workers.Count != 2 {
+					t.Errorf("file values not applied: %+v %+v", cfg.DB, cfg.Workers)
+				}
+				if cfg.Queue.Backend != QueueBackendMemory || cfg.Retry.MaxAttempts != DefaultRetryMaxAttempts {
+					t.Errorf("defaults not applied: %+v %+v", cfg.Queue, cfg.Retry)
+				}
+			},
+		},
+		{
+			name: "env over file",
+			env: map[string]string{
+				"TSV_DB_HOST":                     "env-host",
+				"TSV_SCANNER_INTERVAL":            "1m",
+				"TSV_INGEST_NATURAL_KEY":          "unit_guid, msg_id",
+				"TSV_SCANNER_REQUIRE_DONE_MARKER": "true",
+			},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.DB.Host != "env-host" || cfg.DB.Port != 5433 {
+					t.Errorf("db = %s:%d, want env-host:5433", cfg.DB.Host, cfg.DB.Port)
+				}
+				if cfg.Scanner.Interval != time.Minute || !cfg.Scanner.RequireDoneMarker {
+					t.Errorf("scanner = %+v", cfg.Scanner)
+				}
+				if want := []string{"unit_guid", "msg_id"}; !reflect.DeepEqual(cfg.Ingest.NaturalKey, want) {
+					t.Errorf("natural_key = %v, want %v", cfg.Ingest.NaturalKey, want)
+				}
+			},
+		},
+		{
+			name: "flags over env",
+			env:  map[string]string{"TSV_DB_HOST": "env-host", "TSV_WORKERS_COUNT": "3"},
+			args: []string{"-db.host", "flag-host", "-scanner.require_done_marker"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.DB.Host != "flag-host" || cfg.Workers.Count != 3 || !cfg.Scanner.RequireDoneMarker {
+					t.Errorf("db.host = %s, workers.count = %d, require_done_marker = %t",
+						cfg.DB.Host, cfg.Workers.Count, cfg.Scanner.RequireDoneMarker)
+				}
+			},
+		},
+		{
+			name: "value read from a _FILE variable",
+			env:  map[string]string{"TSV_DB_PASSWORD_FILE": writeFile(t, "password", "s3cret\n")},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.DB.Password != "s3cret" {
+					t.Errorf("password = %q, want the file content without the newline", cfg.DB.Password)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TSV_CONFIG", path)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			cfg, rest, err := Load(append(tt.args, "requeue", "-x"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if want := []string{"requeue", "-x"}; !reflect.DeepEqual(rest, want) {
+				t.Errorf("rest = %v, want %v", rest, want)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	path := writeFile(t, "config.yaml", testYAML)
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		wantErr string
+	}{
+		{
+			name:    "env and _FILE together",
+			env:     map[string]string{"TSV_DB_PASSWORD": "a", "TSV_DB_PASSWORD_FILE": path},
+			wantErr: "both TSV_DB_PASSWORD and TSV_DB_PASSWORD_FILE are set",
+		},
+		{
+			name:    "missing _FILE",
+			env:     map[string]string{"TSV_DB_PASSWORD_FILE": filepath.Join(t.TempDir(), "missing")},
+			wantErr: "failed to read TSV_DB_PASSWORD_FILE",
+		},
+		{
+			name:    "invalid env number",
+			env:     map[string]string{"TSV_DB_PORT": "five"},
+			wantErr: "TSV_DB_PORT: invalid number",
+		},
+		{
+			name:    "invalid env duration",
+			env:     map[string]string{"TSV_SCANNER_INTERVAL": "10"},
+			wantErr: "TSV_SCANNER_INTERVAL: invalid duration",
+		},
+		{
+			name:    "invalid flag boolean",
+			args:    []string{"-ingest.delete_missing=maybe"},
+			wantErr: "invalid boolean",
+		},
+		{
+			name:    "unknown flag",
+			args:    []string{"-db.colour", "red"},
+			wantErr: "flag provided but not defined",
+		},
+		{
+			name:    "missing config file",
+			args:    []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")},
+			wantErr: "failed to read config file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TSV_CONFIG", path)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			_, _, err := Load(tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	var cfg Config
+	names := make(map[string]bool)
+	for _, f := range cfg.fields() {
+		names[f.envName()] = true
+	}
+	for _, want := range []string{"TSV_DB_HOST", "TSV_SCANNER_QUIET_PERIOD", "TSV_QUEUE_RETENTION", "TSV_INGEST_NATURAL_KEY"} {
+		if !names[want] {
+			t.Errorf("no field is overridden by %s", want)
+		}
+	}
+	// maps are only read from the file
+	if names["TSV_VALIDATION_ENUMS"] {
+		t.Error("validation.enums must not be overridable")
+	}
+}
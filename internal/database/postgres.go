@@ -5,31 +5,94 @@ import (
 	"context"
 	"fmt"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"net"
+	"net/url"
+	"strconv"
 	"time"
 )
 
 func NewPool(cfg *config.Config) (*pgxpool.Pool, error) {
-	dsn := fmt.Sprintf(
-		"postgres://%s:%s@%s:%d/%s?sslmode=disable",
-		cfg.DB.User,
-		cfg.DB.Password,
-		cfg.DB.Host,
-		cfg.DB.Port,
-		cfg.DB.Name,
-	)
+	poolCfg, err := poolConfig(&cfg.DB)
+	if err != nil {
+		return nil, err
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	pool, err := pgxpool.New(ctx, dsn)
+	pool, err := pgxpool.NewWithConfig(ctx, poolCfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create database pool: %w", err)
 	}
 
 	// check connection
 	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
 	return pool, nil
 }
+
+// poolConfig parses the connection string and applies the pool settings that are set
+func poolConfig(db *config.DBConfig) (*pgxpool.Config, error) {
+	poolCfg, err := pgxpool.ParseConfig(dsn(db))
+	if err != nil {
+		// pgx redacts the password in the error
+		return nil, fmt.Errorf("invalid database connection settings: %w", err)
+	}
+
+	if db.MaxConns > 0 {
+		poolCfg.MaxConns = int32(db.MaxConns)
+	}
+	if db.MinConns > 0 {
+		poolCfg.MinConns = int32(db.MinConns)
+	}
+	if db.MaxConnLifetime > 0 {
+		poolCfg.MaxConnLifetime = db.MaxConnLifetime
+	}
+	if db.MaxConnIdleTime > 0 {
+		poolCfg.MaxConnIdleTime = db.MaxConnIdleTime
+	}
+
+	params := poolCfg.ConnConfig.RuntimeParams
+	if db.StatementTimeout > 0 {
+		params["statement_timeout"] = strconv.FormatInt(db.StatementTimeout.Milliseconds(), 10)
+	}
+	// a name given in the DSN wins over the default one
+	if _, ok := params["application_name"]; !ok && db.ApplicationName != "" {
+		params["application_name"] = db.ApplicationName
+	}
+
+	return poolCfg, nil
+}
+
+// dsn returns the raw DSN if configured, otherwise builds a postgres:// URL from the connection fields
+func dsn(db *config.DBConfig) string {
+	if db.DSN != "" {
+		return db.DSN
+	}
+
+	query := url.Values{}
+	query.Set("sslmode", db.SSLMode)
+	if db.SSLRootCert != "" {
+		query.Set("sslrootcert", db.SSLRootCert)
+	}
+	if db.SSLCert != "" {
+		query.Set("sslcert", db.SSLCert)
+		query.Set("sslkey", db.SSLKey)
+	}
+
+	u := url.URL{
+		Scheme:   "postgres",
+		Host:     net.JoinHostPort(db.Host, strconv.Itoa(db.Port)),
+		Path:     "/" + db.Name,
+		RawQuery: query.Encode(),
+	}
+	if db.Password != "" {
+		u.User = url.UserPassword(db.User, db.Password)
+	} else {
+		u.User = url.User(db.User)
+	}
+	return u.String()
+}
@@ -0,0 +1,3 @@
+-- Revert: drop messages table
+
+DROP TABLE IF EXISTS "messages";
@@ -0,0 +1,3 @@
+-- Revert: drop processed_files table
+
+DROP TABLE IF EXISTS "processed_files";
@@ -0,0 +1,3 @@
+-- Revert: drop parse_errors table
+
+DROP TABLE IF EXISTS "parse_errors";
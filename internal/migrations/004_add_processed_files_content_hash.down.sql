@@ -0,0 +1,12 @@
+-- Revert: identify processed files by name again
+-- Fails if the same name was processed with different content, those rows must be removed first
+
+DROP INDEX IF EXISTS idx_processed_files_filename;
+DROP INDEX IF EXISTS idx_processed_files_content_hash;
+
+ALTER TABLE "processed_files"
+    DROP COLUMN IF EXISTS content_hash,
+    DROP COLUMN IF EXISTS size,
+    DROP COLUMN IF EXISTS mtime;
+
+ALTER TABLE "processed_files" ADD CONSTRAINT processed_files_filename_key UNIQUE (filename);
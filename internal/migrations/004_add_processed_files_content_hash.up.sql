@@ -0,0 +1,12 @@
+-- Migration: identify processed files by content
+-- A file is identified by the SHA-256 of its content, so the same name may appear in several rows
+
+ALTER TABLE "processed_files" DROP CONSTRAINT IF EXISTS processed_files_filename_key;
+
+ALTER TABLE "processed_files"
+    ADD COLUMN content_hash text,                           -- hex SHA-256 of the file content
+    ADD COLUMN size bigint,                                 -- file size in bytes
+    ADD COLUMN mtime timestamp;                             -- file modification time
+
+CREATE UNIQUE INDEX idx_processed_files_content_hash ON "processed_files"(content_hash);
+CREATE INDEX idx_processed_files_filename ON "processed_files"(filename);
@@ -0,0 +1,10 @@
+-- Revert: parse error locations
+
+DROP INDEX IF EXISTS idx_parse_errors_error_code;
+DROP INDEX IF EXISTS idx_parse_errors_filename;
+
+ALTER TABLE "parse_errors"
+    DROP COLUMN IF EXISTS line_number,
+    DROP COLUMN IF EXISTS byte_offset,
+    DROP COLUMN IF EXISTS column_name,
+    DROP COLUMN IF EXISTS error_code;
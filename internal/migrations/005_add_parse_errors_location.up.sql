@@ -0,0 +1,11 @@
+-- Migration: locate parse errors in their file
+-- Stores where in the file the error happened and a machine readable error code
+
+ALTER TABLE "parse_errors"
+    ADD COLUMN line_number int,                            -- 1-based line number of the broken row
+    ADD COLUMN byte_offset bigint,                         -- byte offset of the start of the row
+    ADD COLUMN column_name text,                           -- column that failed, empty for whole-row errors
+    ADD COLUMN error_code text;                            -- too_few_columns, bad_uuid, bad_level, db_insert, ...
+
+CREATE INDEX idx_parse_errors_filename ON "parse_errors"(filename);
+CREATE INDEX idx_parse_errors_error_code ON "parse_errors"(error_code);
@@ -0,0 +1,3 @@
+-- Revert: processed file locations
+
+ALTER TABLE "processed_files" DROP COLUMN IF EXISTS location;
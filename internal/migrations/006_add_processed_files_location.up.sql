@@ -0,0 +1,5 @@
+-- Migration: remember where processed files are stored
+-- Files are moved to the archive or failed directory after processing
+
+ALTER TABLE "processed_files"
+    ADD COLUMN location text;                               -- path of the file after processing
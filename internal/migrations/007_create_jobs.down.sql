@@ -0,0 +1,3 @@
+-- Revert: drop jobs table
+
+DROP TABLE IF EXISTS "jobs";
@@ -0,0 +1,20 @@
+-- Migration: create jobs table
+-- Durable work queue shared by all service instances, claimed with SELECT ... FOR UPDATE SKIP LOCKED
+
+CREATE TABLE "jobs" (
+                        id uuid PRIMARY KEY DEFAULT gen_random_uuid(),         -- unique identifier
+                        filename text NOT NULL,                                -- file to process
+                        content_hash text NOT NULL,                            -- hex SHA-256 of the file content
+                        status text NOT NULL DEFAULT 'queued',                 -- queued / running / done / failed
+                        attempts int NOT NULL DEFAULT 0,                       -- how many times the job was claimed
+                        locked_by text,                                        -- instance that holds the lease
+                        lease_until timestamp,                                 -- the lease expires at this time
+                        heartbeat_at timestamp,                                -- last heartbeat of the holder
+                        last_error text,                                       -- error of the last failed attempt
+                        created_at timestamp NOT NULL DEFAULT now(),           -- timestamp of creation
+                        updated_at timestamp NOT NULL DEFAULT now()            -- timestamp of the last change
+);
+
+-- one active job per content, so instances scanning the same share don't queue a file twice
+CREATE UNIQUE INDEX idx_jobs_active_content_hash ON "jobs"(content_hash) WHERE status IN ('queued', 'running');
+CREATE INDEX idx_jobs_status_created_at ON "jobs"(status, created_at);
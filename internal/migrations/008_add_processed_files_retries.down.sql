@@ -0,0 +1,8 @@
+-- Revert: retry bookkeeping for processed files
+
+DROP INDEX IF EXISTS idx_processed_files_status;
+
+ALTER TABLE "processed_files"
+    DROP COLUMN IF EXISTS attempts,
+    DROP COLUMN IF EXISTS next_attempt_at,
+    DROP COLUMN IF EXISTS last_error;
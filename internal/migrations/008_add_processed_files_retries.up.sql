@@ -0,0 +1,9 @@
+-- Migration: retry bookkeeping for processed files
+-- Files whose ingest failed are retried with exponential backoff until they are marked dead
+
+ALTER TABLE "processed_files"
+    ADD COLUMN attempts int NOT NULL DEFAULT 0,             -- failed ingest attempts
+    ADD COLUMN next_attempt_at timestamp,                   -- the next retry is not made before this time
+    ADD COLUMN last_error text;                             -- error of the last failed attempt
+
+CREATE INDEX idx_processed_files_status ON "processed_files"(status);
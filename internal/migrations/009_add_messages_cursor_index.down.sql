@@ -0,0 +1,4 @@
+-- Revert: index for keyset pagination of messages
+
+DROP INDEX IF EXISTS idx_messages_created_at_id;
+DROP INDEX IF EXISTS idx_messages_unit_guid_created_at_id;
@@ -0,0 +1,5 @@
+-- Migration: index for keyset pagination of messages
+-- Pages are read in (created_at, id) order, per unit or across all units
+
+CREATE INDEX idx_messages_unit_guid_created_at_id ON "messages"(unit_guid, created_at DESC, id DESC);
+CREATE INDEX idx_messages_created_at_id ON "messages"(created_at DESC, id DESC);
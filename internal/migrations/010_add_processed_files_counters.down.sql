@@ -0,0 +1,6 @@
+-- Revert: per-file ingest counters
+
+ALTER TABLE "processed_files"
+    DROP COLUMN IF EXISTS row_count,
+    DROP COLUMN IF EXISTS message_count,
+    DROP COLUMN IF EXISTS error_count;
@@ -0,0 +1,7 @@
+-- Migration: per-file ingest counters
+-- Filled by the parser, so the API can report a file's result without counting rows
+
+ALTER TABLE "processed_files"
+    ADD COLUMN row_count int NOT NULL DEFAULT 0,            -- data rows read, without the header
+    ADD COLUMN message_count int NOT NULL DEFAULT 0,        -- messages stored
+    ADD COLUMN error_count int NOT NULL DEFAULT 0;          -- parse errors recorded
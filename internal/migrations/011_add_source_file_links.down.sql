@@ -0,0 +1,7 @@
+-- Revert: source file links of messages and parse errors
+
+DROP INDEX IF EXISTS idx_parse_errors_file_id;
+DROP INDEX IF EXISTS idx_messages_source_file_id;
+
+ALTER TABLE "parse_errors" DROP COLUMN IF EXISTS file_id;
+ALTER TABLE "messages" DROP COLUMN IF EXISTS source_file_id;
@@ -0,0 +1,11 @@
+-- Migration: link messages and parse errors to the file they came from
+-- Lets a file's data be deleted or reprocessed; rows ingested before this migration have no link
+
+ALTER TABLE "messages"
+    ADD COLUMN source_file_id uuid REFERENCES "processed_files"(id) ON DELETE SET NULL;  -- file the message was read from
+
+ALTER TABLE "parse_errors"
+    ADD COLUMN file_id uuid REFERENCES "processed_files"(id) ON DELETE SET NULL;         -- file the error was found in
+
+CREATE INDEX idx_messages_source_file_id ON "messages"(source_file_id);
+CREATE INDEX idx_parse_errors_file_id ON "parse_errors"(file_id);
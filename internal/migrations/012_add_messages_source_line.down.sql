@@ -0,0 +1,6 @@
+-- Revert: line of the source file of messages
+
+CREATE INDEX IF NOT EXISTS idx_messages_source_file_id ON "messages"(source_file_id);
+DROP INDEX IF EXISTS idx_messages_source_file_line;
+
+ALTER TABLE "messages" DROP COLUMN IF EXISTS source_line;
@@ -0,0 +1,8 @@
+-- Migration: line of the source file each message was read from
+-- Together with source_file_id tells which export introduced a message; rows ingested before this migration have none
+
+ALTER TABLE "messages"
+    ADD COLUMN source_line int;  -- 1-based line number in the source file
+
+CREATE INDEX idx_messages_source_file_line ON "messages"(source_file_id, source_line);
+DROP INDEX IF EXISTS idx_messages_source_file_id;
@@ -0,0 +1,3 @@
+-- Revert: natural key index of messages
+
+DROP INDEX IF EXISTS idx_messages_unit_guid_msg_id;
@@ -0,0 +1,5 @@
+-- Migration: index for matching messages by the default natural key
+-- In upsert mode a file's messages are matched to the stored ones of the unit by (unit_guid, msg_id).
+-- Not unique: files ingested in append mode, or before it, may hold several messages with one key
+
+CREATE INDEX idx_messages_unit_guid_msg_id ON "messages"(unit_guid, msg_id);
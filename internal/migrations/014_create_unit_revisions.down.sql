@@ -0,0 +1,4 @@
+-- Revert: revision history of unit message definitions
+
+DROP TABLE IF EXISTS "message_versions";
+DROP TABLE IF EXISTS "unit_revisions";
@@ -0,0 +1,41 @@
+-- Migration: revision history of unit message definitions
+-- Every ingest of a unit is a revision, every message keeps the versions it had between revisions
+
+CREATE TABLE "unit_revisions" (
+                                  id uuid PRIMARY KEY DEFAULT gen_random_uuid(),          -- unique identifier
+                                  unit_guid uuid NOT NULL,                                -- device GUID
+                                  revision int NOT NULL,                                  -- 1, 2, ... per unit in ingest order
+                                  file_id uuid REFERENCES "processed_files"(id) ON DELETE SET NULL, -- ingested file
+                                  message_count int NOT NULL DEFAULT 0,                   -- messages of the unit in the file
+                                  created_at timestamp NOT NULL DEFAULT now()             -- time of the ingest
+);
+
+CREATE UNIQUE INDEX idx_unit_revisions_unit_guid_revision ON "unit_revisions"(unit_guid, revision);
+CREATE INDEX idx_unit_revisions_unit_guid_created_at ON "unit_revisions"(unit_guid, created_at);
+
+CREATE TABLE "message_versions" (
+                                    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),  -- unique identifier
+                                    mqtt text,                                      -- the columns of messages
+                                    unit_guid uuid NOT NULL,
+                                    msg_id text,
+                                    text text,
+                                    context text,
+                                    class text,
+                                    level int,
+                                    area text,
+                                    addr text,
+                                    block text NULL,
+                                    type text,
+                                    bit text NULL,
+                                    invert_bit text NULL,
+                                    created_at timestamp NOT NULL DEFAULT now(),
+                                    source_file_id uuid REFERENCES "processed_files"(id) ON DELETE SET NULL,
+                                    source_line int,
+                                    valid_from timestamp NOT NULL,                  -- time of the revision that introduced the version
+                                    valid_to timestamp,                             -- time of the revision that replaced it, NULL if current
+                                    from_revision int NOT NULL,                     -- revision that introduced the version
+                                    to_revision int                                 -- revision that replaced or removed it
+);
+
+CREATE INDEX idx_message_versions_unit_guid_revisions ON "message_versions"(unit_guid, from_revision, to_revision);
+CREATE INDEX idx_message_versions_current ON "message_versions"(unit_guid) WHERE valid_to IS NULL;
@@ -0,0 +1,26 @@
+-- Revert: store times with their time zone
+
+ALTER TABLE "message_versions"
+    ALTER COLUMN created_at TYPE timestamp,
+    ALTER COLUMN valid_from TYPE timestamp,
+    ALTER COLUMN valid_to TYPE timestamp;
+
+ALTER TABLE "unit_revisions"
+    ALTER COLUMN created_at TYPE timestamp;
+
+ALTER TABLE "jobs"
+    ALTER COLUMN lease_until TYPE timestamp,
+    ALTER COLUMN heartbeat_at TYPE timestamp,
+    ALTER COLUMN created_at TYPE timestamp,
+    ALTER COLUMN updated_at TYPE timestamp;
+
+ALTER TABLE "parse_errors"
+    ALTER COLUMN created_at TYPE timestamp;
+
+ALTER TABLE "processed_files"
+    ALTER COLUMN processed_at TYPE timestamp,
+    ALTER COLUMN mtime TYPE timestamp,
+    ALTER COLUMN next_attempt_at TYPE timestamp;
+
+ALTER TABLE "messages"
+    ALTER COLUMN created_at TYPE timestamp;
@@ -0,0 +1,28 @@
+-- Migration: store times with their time zone
+-- Filters and cursors from the API carry an offset; a timestamp without time zone dropped it and compared wall clocks.
+-- Stored values are read in the session time zone, the one now() wrote them in
+
+ALTER TABLE "messages"
+    ALTER COLUMN created_at TYPE timestamptz;
+
+ALTER TABLE "processed_files"
+    ALTER COLUMN processed_at TYPE timestamptz,
+    ALTER COLUMN mtime TYPE timestamptz,
+    ALTER COLUMN next_attempt_at TYPE timestamptz;
+
+ALTER TABLE "parse_errors"
+    ALTER COLUMN created_at TYPE timestamptz;
+
+ALTER TABLE "jobs"
+    ALTER COLUMN lease_until TYPE timestamptz,
+    ALTER COLUMN heartbeat_at TYPE timestamptz,
+    ALTER COLUMN created_at TYPE timestamptz,
+    ALTER COLUMN updated_at TYPE timestamptz;
+
+ALTER TABLE "unit_revisions"
+    ALTER COLUMN created_at TYPE timestamptz;
+
+ALTER TABLE "message_versions"
+    ALTER COLUMN created_at TYPE timestamptz,
+    ALTER COLUMN valid_from TYPE timestamptz,
+    ALTER COLUMN valid_to TYPE timestamptz;
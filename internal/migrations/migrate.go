@@ -0,0 +1,207 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"log"
+	"time"
+)
+
+// lockKey is the advisory lock held while migrating, so replicas starting together don't race
+const lockKey int64 = 0x7473765f6d6967 // "tsv_mig"
+
+// Migrator applies the embedded migrations and records them in schema_migrations
+type Migrator struct {
+	db         *pgxpool.Pool
+	migrations []Migration
+}
+
+// Status is a migration and when it was applied, AppliedAt is nil for pending ones
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// New creates a Migrator for the embedded migrations
+func New(db *pgxpool.Pool) (*Migrator, error) {
+	migrations, err := load(files)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// Up applies all pending migrations in version order, each one in its own transaction.
+// It returns how many were applied.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	applied := 0
+	err := m.locked(ctx, func(conn *pgxpool.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if _, ok := versions[mig.Version]; ok {
+				continue
+			}
+			log.Printf("[migrate] applying %03d_%s", mig.Version, mig.Name)
+			if err := apply(ctx, conn, mig.Up, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`,
+				mig.Version, mig.Name); err != nil {
+				return fmt.Errorf("migration %03d_%s failed: %w", mig.Version, mig.Name, err)
+			}
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts the last n applied migrations, newest first. It returns how many were reverted.
+func (m *Migrator) Down(ctx context.Context, n int) (int, error) {
+	reverted := 0
+	err := m.locked(ctx, func(conn *pgxpool.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && reverted < n; i-- {
+			mig := m.migrations[i]
+			if _, ok := versions[mig.Version]; !ok {
+				continue
+			}
+			if mig.Down == "" {
+				return fmt.Errorf("migration %03d_%s can't be reverted, it has no down file", mig.Version, mig.Name)
+			}
+			log.Printf("[migrate] reverting %03d_%s", mig.Version, mig.Name)
+			if err := apply(ctx, conn, mig.Down, `DELETE FROM schema_migrations WHERE version=$1`,
+				mig.Version); err != nil {
+				return fmt.Errorf("reverting migration %03d_%s failed: %w", mig.Version, mig.Name, err)
+			}
+			reverted++
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Force marks every migration up to version as applied and every later one as pending,
+// without running them. It is used to adopt a database whose schema was created by hand.
+func (m *Migrator) Force(ctx context.Context, version int) error {
+	return m.locked(ctx, func(conn *pgxpool.Conn) error {
+		return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, `DELETE FROM schema_migrations`); err != nil {
+				return err
+			}
+			for _, mig := range m.migrations {
+				if mig.Version > version {
+					break
+				}
+				if _, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`,
+					mig.Version, mig.Name); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// Status lists all migrations with the time they were applied
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+	err := m.locked(ctx, func(conn *pgxpool.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			s := Status{Migration: mig}
+			if at, ok := versions[mig.Version]; ok {
+				s.AppliedAt = &at
+			}
+			statuses = append(statuses, s)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// locked runs fn on a single connection holding the migration advisory lock
+func (m *Migrator) locked(ctx context.Context, fn func(conn *pgxpool.Conn) error) (err error) {
+	conn, err := m.db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection for migrations: %w", err)
+	}
+	defer conn.Release()
+
+	// waiting for another replica and long migrations must not hit db.statement_timeout,
+	// RESET brings the connection back to the configured timeout before it returns to the pool
+	if _, err := conn.Exec(ctx, `SET statement_timeout = 0`); err != nil {
+		return fmt.Errorf("failed to disable statement timeout for migrations: %w", err)
+	}
+	defer func() {
+		if _, resetErr := conn.Exec(context.Background(), `RESET statement_timeout`); resetErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to reset statement timeout: %w", resetErr))
+		}
+	}()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, lockKey); err != nil {
+		return fmt.Errorf("failed to take migration lock: %w", err)
+	}
+	defer func() {
+		// the context may be canceled already, the lock must be released anyway
+		if _, unlockErr := conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, lockKey); unlockErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to release migration lock: %w", unlockErr))
+		}
+	}()
+
+	if _, err := conn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+		    version bigint PRIMARY KEY,
+		    name text NOT NULL,
+		    applied_at timestamp NOT NULL DEFAULT now()
+		)
+	`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	return fn(conn)
+}
+
+// appliedVersions returns the applied migration versions with the time they were applied
+func appliedVersions(ctx context.Context, conn *pgxpool.Conn) (map[int]time.Time, error) {
+	rows, err := conn.Query(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	versions := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, fmt.Errorf("failed to scan schema_migrations: %w", err)
+		}
+		versions[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+	return versions, nil
+}
+
+// apply runs the migration script and the bookkeeping statement in one transaction
+func apply(ctx context.Context, conn *pgxpool.Conn, script string, record string, args ...any) error {
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		// without arguments the script is sent with the simple protocol, which allows several statements
+		if _, err := tx.Exec(ctx, script); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, record, args...)
+		return err
+	})
+}
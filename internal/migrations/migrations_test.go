@@ -0,0 +1,114 @@
+package migrations
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    []string
+		versions []int
+		wantErr  string
+	}{
+		{
+			name:     "ordered by version, not by name",
+			files:    []string{"010_c.up.sql", "002_b.up.sql", "002_b.down.sql", "001_a.up.sql", "001_a.down.sql"},
+			versions: []int{1, 2, 10},
+		},
+		{
+			name:     "down file is optional",
+			files:    []string{"001_a.up.sql"},
+			versions: []int{1},
+		},
+		{
+			name:     "underscores in the name",
+			files:    []string{"003_add_messages_index.up.sql"},
+			versions: []int{3},
+		},
+		{name: "no migrations"},
+		{
+			name:    "missing up file",
+			files:   []string{"001_a.down.sql"},
+			wantErr: "has no up file",
+		},
+		{
+			name:    "two names for a version",
+			files:   []string{"001_a.up.sql", "001_b.down.sql"},
+			wantErr: "has two names",
+		},
+		{
+			name:    "no direction",
+			files:   []string{"001_a.sql"},
+			wantErr: "name must be",
+		},
+		{
+			name:    "no name",
+			files:   []string{"001.up.sql"},
+			wantErr: "name must be",
+		},
+		{
+			name:    "version is not a number",
+			files:   []string{"abc_a.up.sql"},
+			wantErr: "invalid version",
+		},
+		{
+			name:    "version zero",
+			files:   []string{"000_a.up.sql"},
+			wantErr: "invalid version",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{}
+			for _, f := range tt.files {
+				fsys[f] = &fstest.MapFile{Data: []byte("-- " + f)}
+			}
+
+			migrations, err := load(fsys)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(migrations) != len(tt.versions) {
+				t.Fatalf("got %d migrations, want %d", len(migrations), len(tt.versions))
+			}
+			for i, m := range migrations {
+				if m.Version != tt.versions[i] {
+					t.Errorf("migration %d has version %d, want %d", i, m.Version, tt.versions[i])
+				}
+				if want := fmt.Sprintf("-- %03d_%s.up.sql", m.Version, m.Name); m.Up != want {
+					t.Errorf("migration %d has up %q", m.Version, m.Up)
+				}
+			}
+		})
+	}
+}
+
+// TestEmbedded checks the migrations shipped in the binary: they load, every one can be reverted
+// and the versions have no gaps
+func TestEmbedded(t *testing.T) {
+	migrations, err := load(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no embedded migrations")
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %03d_%s: want version %d", m.Version, m.Name, i+1)
+		}
+		if strings.TrimSpace(m.Down) == "" {
+			t.Errorf("migration %03d_%s has no down file", m.Version, m.Name)
+		}
+	}
+}
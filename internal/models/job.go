@@ -0,0 +1,29 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// job statuses
+const (
+	JobStatusQueued  = "queued"
+	JobStatusRunning = "running"
+	JobStatusDone    = "done"
+	JobStatusFailed  = "failed"
+)
+
+// Job is a file waiting in or taken from the durable queue
+type Job struct {
+	ID          uuid.UUID  `db:"id" json:"id"`
+	Filename    string     `db:"filename" json:"filename"`
+	ContentHash string     `db:"content_hash" json:"content_hash"`
+	Status      string     `db:"status" json:"status"` // queued / running / done / failed
+	Attempts    int        `db:"attempts" json:"attempts"`
+	LockedBy    *string    `db:"locked_by" json:"locked_by"`
+	LeaseUntil  *time.Time `db:"lease_until" json:"lease_until"`
+	HeartbeatAt *time.Time `db:"heartbeat_at" json:"heartbeat_at"`
+	LastError   *string    `db:"last_error" json:"last_error"`
+	CreatedAt   time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt   time.Time  `db:"updated_at" json:"updated_at"`
+}
@@ -5,11 +5,30 @@ import (
 	"time"
 )
 
+// parse error codes
+const (
+	ErrCodeBadHeader     = "bad_header"      // the header line can't be mapped to columns
+	ErrCodeTooFewColumns = "too_few_columns" // the row has fewer fields than the layout needs
+	ErrCodeBadUUID       = "bad_uuid"        // unit_guid is not a valid UUID
+	ErrCodeBadLevel      = "bad_level"       // level is not an integer
+	ErrCodeDBInsert      = "db_insert"       // the database rejected the row
+	ErrCodeMissingValue  = "missing_value"   // a required field is empty
+	ErrCodeBadEnum       = "bad_enum"        // the value is not one of the allowed ones
+	ErrCodeBadNumber     = "bad_number"      // a field with a range rule is not an integer
+	ErrCodeOutOfRange    = "out_of_range"    // the number is outside the allowed range
+	ErrCodeBadFormat     = "bad_format"      // the value doesn't match the pattern
+)
+
 // ParseError is an error when parsing a file
 type ParseError struct {
-	ID        uuid.UUID `db:"id" json:"id"`
-	Filename  string    `db:"filename" json:"filename"`
-	RawLine   string    `db:"raw_line" json:"raw_line"`
-	ErrorText string    `db:"error_text" json:"error_text"`
-	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	ID         uuid.UUID  `db:"id" json:"id"`
+	FileID     *uuid.UUID `db:"file_id" json:"file_id"` // processed_files row of the file, nil for old rows
+	Filename   string     `db:"filename" json:"filename"`
+	LineNumber int        `db:"line_number" json:"line_number"` // 1-based
+	ByteOffset int64      `db:"byte_offset" json:"byte_offset"` // start of the row in the file
+	ColumnName string     `db:"column_name" json:"column_name"` // empty for whole-row errors
+	ErrorCode  string     `db:"error_code" json:"error_code"`
+	RawLine    string     `db:"raw_line" json:"raw_line"`
+	ErrorText  string     `db:"error_text" json:"error_text"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
 }
@@ -5,10 +5,36 @@ import (
 	"time"
 )
 
+// processed file statuses
+const (
+	FileStatusQueued  = "queued"  // uploaded, waiting for a worker
+	FileStatusParsing = "parsing" // a worker is ingesting it
+	FileStatusSuccess = "success" // ingested without errors
+	FileStatusFailed  = "failed"  // ingested, some rows had errors
+	FileStatusRetry   = "retry"   // the ingest itself failed, it is retried after next_attempt_at
+	FileStatusDead    = "dead"    // the ingest failed too many times, it waits for a manual requeue
+	FileStatusPurged  = "purged"  // its data was deleted on request, it is not ingested again unless reprocessed
+)
+
 // ProcessedFile is a file that has already been processed
 type ProcessedFile struct {
-	ID          uuid.UUID `db:"id" json:"id"`
-	Filename    string    `db:"filename" json:"filename"`
-	ProcessedAt time.Time `db:"processed_at" json:"processed_at"`
-	Status      string    `db:"status" json:"status"` // success / failed
+	ID            uuid.UUID  `db:"id" json:"id"`
+	Filename      string     `db:"filename" json:"filename"`
+	ContentHash   string     `db:"content_hash" json:"content_hash"` // hex SHA-256 of the content
+	Size          int64      `db:"size" json:"size"`
+	MTime         time.Time  `db:"mtime" json:"mtime"`
+	Location      string     `db:"location" json:"location"` // where the file is after processing
+	ProcessedAt   time.Time  `db:"processed_at" json:"processed_at"`
+	Status        string     `db:"status" json:"status"`     // queued / parsing / success / failed / retry / dead / purged
+	Attempts      int        `db:"attempts" json:"attempts"` // failed ingest attempts
+	NextAttemptAt *time.Time `db:"next_attempt_at" json:"next_attempt_at"`
+	LastError     *string    `db:"last_error" json:"last_error"`
+	RowCount      int        `db:"row_count" json:"row_count"`         // data rows read, without the header
+	MessageCount  int        `db:"message_count" json:"message_count"` // messages stored
+	ErrorCount    int        `db:"error_count" json:"error_count"`     // parse errors recorded
+}
+
+// Finished reports whether ingesting the file ran to the end, with or without parse errors
+func (f *ProcessedFile) Finished() bool {
+	return f.Status == FileStatusSuccess || f.Status == FileStatusFailed
 }
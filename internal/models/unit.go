@@ -0,0 +1,18 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// UnitSummary is what is stored about a unit: its messages counted and where they came from
+type UnitSummary struct {
+	UnitGUID         uuid.UUID      `json:"unit_guid"`
+	MessageCount     int            `json:"message_count"`
+	ByClass          map[string]int `json:"by_class"` // messages per class
+	ByLevel          map[string]int `json:"by_level"` // messages per level
+	FirstIngestAt    time.Time      `json:"first_ingest_at"`
+	LastIngestAt     time.Time      `json:"last_ingest_at"`
+	LastSourceFileID *uuid.UUID     `json:"last_source_file_id"` // nil when no message is linked to a file
+	LastSourceFile   *string        `json:"last_source_file"`    // filename of the last source file
+}
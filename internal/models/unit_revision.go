@@ -0,0 +1,54 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// UnitRevision is one ingest of a unit's message definitions
+type UnitRevision struct {
+	ID           uuid.UUID  `db:"id" json:"id"`
+	UnitGUID     uuid.UUID  `db:"unit_guid" json:"unit_guid"`
+	Revision     int        `db:"revision" json:"revision"` // 1, 2, ... per unit in ingest order
+	FileID       *uuid.UUID `db:"file_id" json:"file_id"`   // processed_files row of the ingested file
+	MessageCount int        `db:"message_count" json:"message_count"`
+	CreatedAt    time.Time  `db:"created_at" json:"created_at"`
+}
+
+// MessageVersion is a message of a unit as it was defined from one revision until it changed or was removed
+type MessageVersion struct {
+	Message
+	ValidFrom    time.Time  `db:"valid_from" json:"valid_from"`
+	ValidTo      *time.Time `db:"valid_to" json:"valid_to"` // nil while it is the current version
+	FromRevision int        `db:"from_revision" json:"from_revision"`
+	ToRevision   *int       `db:"to_revision" json:"to_revision"` // first revision without this version
+}
+
+// UnitDiff is what changed in the messages of a unit from one revision to another
+type UnitDiff struct {
+	UnitGUID uuid.UUID        `json:"unit_guid"`
+	From     *UnitRevision    `json:"from"` // nil compares with the unit before its first ingest
+	To       *UnitRevision    `json:"to"`
+	Added    []MessageVersion `json:"added"`
+	Removed  []MessageVersion `json:"removed"`
+	Modified []MessageChange  `json:"modified"`
+}
+
+// MessageChange is a message whose fields differ between two revisions
+type MessageChange struct {
+	From    MessageVersion `json:"from"`
+	To      MessageVersion `json:"to"`
+	Changes []FieldChange  `json:"changes"`
+}
+
+// FieldChange is one changed field of a message, values are nil for empty optional fields
+type FieldChange struct {
+	Field string `json:"field"` // column name
+	From  any    `json:"from"`
+	To    any    `json:"to"`
+}
+
+// Empty reports whether nothing changed
+func (d *UnitDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
@@ -0,0 +1,155 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// column names known to the parser
+const (
+	colMQTT      = "mqtt"
+	colN         = "n"
+	colUnitGUID  = "unit_guid"
+	colMsgID     = "msg_id"
+	colText      = "text"
+	colContext   = "context"
+	colClass     = "class"
+	colLevel     = "level"
+	colArea      = "area"
+	colAddr      = "addr"
+	colBlock     = "block"
+	colType      = "type"
+	colBit       = "bit"
+	colInvertBit = "invert_bit"
+)
+
+// positionalColumns is the column order used when a file has no header line
+var positionalColumns = []string{
+	colMQTT,
+	colN,
+	colUnitGUID,
+	colMsgID,
+	colText,
+	colContext,
+	colClass,
+	colLevel,
+	colArea,
+	colAddr,
+	colBlock,
+	colType,
+	colBit,
+	colInvertBit,
+}
+
+// requiredColumns must be present in a header line
+var requiredColumns = []string{colUnitGUID, colLevel}
+
+// columnAliases maps normalized header names to column names
+var columnAliases = map[string]string{
+	"mqtt":      colMQTT,
+	"topic":     colMQTT,
+	"n":         colN,
+	"no":        colN,
+	"num":       colN,
+	"unitguid":  colUnitGUID,
+	"unitid":    colUnitGUID,
+	"unituuid":  colUnitGUID,
+	"msgid":     colMsgID,
+	"messageid": colMsgID,
+	"text":      colText,
+	"message":   colText,
+	"context":   colContext,
+	"class":     colClass,
+	"level":     colLevel,
+	"area":      colArea,
+	"addr":      colAddr,
+	"address":   colAddr,
+	"block":     colBlock,
+	"type":      colType,
+	"bit":       colBit,
+	"invertbit": colInvertBit,
+	"bitinvert": colInvertBit,
+}
+
+// minHeaderMatches is how many known column names a line needs to be treated as a header
+const minHeaderMatches = 3
+
+// layout maps column names to their index in a record
+type layout struct {
+	index   map[string]int
+	minCols int // fields a row needs to have
+}
+
+// positionalLayout returns the layout of a file without a header line
+func positionalLayout() *layout {
+	l := &layout{
+		index:   make(map[string]int, len(positionalColumns)),
+		minCols: len(positionalColumns),
+	}
+	for i, col := range positionalColumns {
+		l.index[col] = i
+	}
+	return l
+}
+
+// detectHeader checks whether the record is a header line and builds the layout from it.
+// It returns false if the record looks like data.
+func detectHeader(record []string) (*layout, bool, error) {
+	var matches int
+	var hasUnitGUID bool
+	for _, name := range record {
+		col, ok := columnAliases[normalizeColumnName(name)]
+		if !ok {
+			continue
+		}
+		matches++
+		if col == colUnitGUID {
+			hasUnitGUID = true
+		}
+	}
+	if matches < minHeaderMatches || !hasUnitGUID {
+		return nil, false, nil
+	}
+
+	l := &layout{index: make(map[string]int, len(record))}
+	for i, name := range record {
+		col, ok := columnAliases[normalizeColumnName(name)]
+		if !ok {
+			continue
+		}
+		if _, dup := l.index[col]; dup {
+			return nil, true, fmt.Errorf("duplicate column %q in header", name)
+		}
+		l.index[col] = i
+	}
+	for _, col := range requiredColumns {
+		if _, ok := l.index[col]; !ok {
+			return nil, true, fmt.Errorf("header is missing required column %s", col)
+		}
+		// a row may end after its last required column, the optional ones it lacks are empty
+		l.minCols = max(l.minCols, l.index[col]+1)
+	}
+	return l, true, nil
+}
+
+// value returns the field of the record for the column or "" if the file has no such column
+func (l *layout) value(record []string, col string) string {
+	i, ok := l.index[col]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return record[i]
+}
+
+// normalizeColumnName lowercases the name and drops everything except letters and digits,
+// so "unit_guid", "unitGUID" and "Unit GUID" are the same column (a UTF-8 BOM is dropped too)
+func normalizeColumnName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return b.String()
+}
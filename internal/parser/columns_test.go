@@ -0,0 +1,149 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeColumnName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"unit_guid", "unitguid"},
+		{"unitGUID", "unitguid"},
+		{"Unit GUID", "unitguid"},
+		{"\ufeffmqtt", "mqtt"},
+		{" Invert-Bit ", "invertbit"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeColumnName(tt.name); got != tt.want {
+			t.Errorf("normalizeColumnName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDetectHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		record   string
+		isHeader bool
+		wantErr  string
+		index    map[string]int
+		minCols  int
+	}{
+		{
+			name:     "canonical names",
+			record:   "mqtt\tn\tunit_guid\tmsg_id\ttext\tcontext\tclass\tlevel\tarea\taddr\tblock\ttype\tbit\tinvert_bit",
+			isHeader: true,
+			index:    map[string]int{colMQTT: 0, colN: 1, colUnitGUID: 2, colLevel: 7, colInvertBit: 13},
+			minCols:  8,
+		},
+		{
+			name:     "aliases in any order",
+			record:   "Level\tAddress\tUnit GUID\tMessage\ttopic",
+			isHeader: true,
+			index:    map[string]int{colLevel: 0, colAddr: 1, colUnitGUID: 2, colText: 3, colMQTT: 4},
+			minCols:  3,
+		},
+		{
+			name:     "unknown columns are ignored",
+			record:   "comment\tunit_guid\tlevel\ttext",
+			isHeader: true,
+			index:    map[string]int{colUnitGUID: 1, colLevel: 2, colText: 3},
+			minCols:  3,
+		},
+		{
+			name:   "data row",
+			record: "\t1\t11111111-1111-1111-1111-111111111111\tM1\ttext\tctx\talarm\t2\tHR\t10\t\tbool\t0\t0",
+		},
+		{
+			name:   "too few known names",
+			record: "unit_guid\tlevel\tfoo",
+		},
+		{
+			name:   "no unit_guid",
+			record: "text\tclass\tlevel\tarea",
+		},
+		{
+			name:     "missing level",
+			record:   "unit_guid\ttext\tclass",
+			isHeader: true,
+			wantErr:  "missing required column level",
+		},
+		{
+			name:     "duplicate column",
+			record:   "unit_guid\tlevel\taddr\taddress",
+			isHeader: true,
+			wantErr:  "duplicate column",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, isHeader, err := detectHeader(strings.Split(tt.record, "\t"))
+			if isHeader != tt.isHeader {
+				t.Fatalf("isHeader = %t, want %t", isHeader, tt.isHeader)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !isHeader {
+				return
+			}
+			for col, i := range tt.index {
+				if got, ok := l.index[col]; !ok || got != i {
+					t.Errorf("index[%s] = %d, %t, want %d", col, got, ok, i)
+				}
+			}
+			if l.minCols != tt.minCols {
+				t.Errorf("minCols = %d, want %d", l.minCols, tt.minCols)
+			}
+		})
+	}
+}
+
+func TestLayoutValue(t *testing.T) {
+	l, _, err := detectHeader([]string{"unit_guid", "level", "text", "n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a row may stop after its last required column
+	record := []string{"11111111-1111-1111-1111-111111111111", "3"}
+	if len(record) < l.minCols {
+		t.Fatalf("row with every required column is shorter than minCols %d", l.minCols)
+	}
+	tests := []struct {
+		col  string
+		want string
+	}{
+		{colUnitGUID, "11111111-1111-1111-1111-111111111111"},
+		{colLevel, "3"},
+		{colText, ""},  // in the header, missing from the row
+		{colClass, ""}, // not in the header
+	}
+	for _, tt := range tests {
+		if got := l.value(record, tt.col); got != tt.want {
+			t.Errorf("value(%s) = %q, want %q", tt.col, got, tt.want)
+		}
+	}
+}
+
+func TestPositionalLayout(t *testing.T) {
+	l := positionalLayout()
+	if l.minCols != len(positionalColumns) {
+		t.Errorf("minCols = %d, want %d", l.minCols, len(positionalColumns))
+	}
+	for i, col := range positionalColumns {
+		if l.index[col] != i {
+			t.Errorf("index[%s] = %d, want %d", col, l.index[col], i)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package parser
+
+import (
+	"biocad-tsv-service/internal/config"
+	"biocad-tsv-service/internal/models"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rules validates message fields against the rules from the config
+type Rules struct {
+	required   []string
+	enums      map[string]map[string]struct{}
+	ignoreCase bool
+	ranges     map[string]config.RangeRule
+	patterns   map[string]*regexp.Regexp
+	fields     []string // every field with a rule, in a stable order
+}
+
+// violation is a field that broke a rule
+type violation struct {
+	column string
+	code   string
+	text   string
+}
+
+// NewRules compiles the validation config. It fails on unknown fields and invalid patterns,
+// so a typo in the rules is reported at startup instead of rejecting every row.
+func NewRules(cfg config.ValidationConfig) (*Rules, error) {
+	known := make(map[string]struct{}, len(positionalColumns))
+	for _, col := range positionalColumns {
+		known[col] = struct{}{}
+	}
+	fields := make(map[string]struct{})
+	checkField := func(field string) error {
+		if _, ok := known[field]; !ok {
+			return fmt.Errorf("unknown field %q in validation rules", field)
+		}
+		fields[field] = struct{}{}
+		return nil
+	}
+
+	r := &Rules{
+		enums:      make(map[string]map[string]struct{}, len(cfg.Enums)),
+		ignoreCase: cfg.IgnoreCase,
+		ranges:     make(map[string]config.RangeRule, len(cfg.Ranges)),
+		patterns:   make(map[string]*regexp.Regexp, len(cfg.Patterns)),
+	}
+
+	for _, field := range cfg.Required {
+		if err := checkField(field); err != nil {
+			return nil, err
+		}
+		r.required = append(r.required, field)
+	}
+	for field, values := range cfg.Enums {
+		if err := checkField(field); err != nil {
+			return nil, err
+		}
+		allowed := make(map[string]struct{}, len(values))
+		for _, v := range values {
+			allowed[r.fold(v)] = struct{}{}
+		}
+		r.enums[field] = allowed
+	}
+	for field, rng := range cfg.Ranges {
+		if err := checkField(field); err != nil {
+			return nil, err
+		}
+		r.ranges[field] = rng
+	}
+	for field, pattern := range cfg.Patterns {
+		if err := checkField(field); err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for %s: %w", field, err)
+		}
+		r.patterns[field] = re
+	}
+
+	for field := range fields {
+		r.fields = append(r.fields, field)
+	}
+	sort.Strings(r.fields)
+	return r, nil
+}
+
+// Empty reports whether there are no rules to check
+func (r *Rules) Empty() bool {
+	return r == nil || len(r.fields) == 0
+}
+
+// check validates one row and returns every broken rule. value returns the field of the row.
+// Empty values are only checked by the required rule.
+func (r *Rules) check(value func(column string) string) []violation {
+	if r.Empty() {
+		return nil
+	}
+
+	var violations []violation
+	for _, field := range r.required {
+		if strings.TrimSpace(value(field)) == "" {
+			violations = append(violations, violation{field, models.ErrCodeMissingValue, fmt.Sprintf("%s is required", field)})
+		}
+	}
+
+	for _, field := range r.fields {
+		v := strings.TrimSpace(value(field))
+		if v == "" {
+			continue
+		}
+
+		if allowed, ok := r.enums[field]; ok {
+			if _, ok := allowed[r.fold(v)]; !ok {
+				violations = append(violations, violation{field, models.ErrCodeBadEnum, fmt.Sprintf("%s value %q is not allowed", field, v)})
+			}
+		}
+
+		if rng, ok := r.ranges[field]; ok {
+			n, err := strconv.Atoi(v)
+			switch {
+			case err != nil:
+				violations = append(violations, violation{field, models.ErrCodeBadNumber, fmt.Sprintf("%s value %q is not an integer", field, v)})
+			case rng.Min != nil && n < *rng.Min, rng.Max != nil && n > *rng.Max:
+				violations = append(violations, violation{field, models.ErrCodeOutOfRange, fmt.Sprintf("%s value %d is out of range %s", field, n, formatRange(rng))})
+			}
+		}
+
+		if re, ok := r.patterns[field]; ok && !re.MatchString(v) {
+			violations = append(violations, violation{field, models.ErrCodeBadFormat, fmt.Sprintf("%s value %q doesn't match %s", field, v, re)})
+		}
+	}
+	return violations
+}
+
+// fold normalizes an enum value for comparison
+func (r *Rules) fold(v string) string {
+	v = strings.TrimSpace(v)
+	if r.ignoreCase {
+		return strings.ToLower(v)
+	}
+	return v
+}
+
+// formatRange renders a range rule as [min, max] with open bounds shown as ..
+func formatRange(rng config.RangeRule) string {
+	lo, hi := "..", ".."
+	if rng.Min != nil {
+		lo = strconv.Itoa(*rng.Min)
+	}
+	if rng.Max != nil {
+		hi = strconv.Itoa(*rng.Max)
+	}
+	return fmt.Sprintf("[%s, %s]", lo, hi)
+}
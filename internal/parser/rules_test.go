@@ -0,0 +1,191 @@
+package parser
+
+import (
+	"biocad-tsv-service/internal/config"
+	"biocad-tsv-service/internal/models"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func intPtr(n int) *int {
+	return &n
+}
+
+func TestNewRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.ValidationConfig
+		wantErr string
+	}{
+		{name: "no rules"},
+		{
+			name: "valid rules",
+			cfg: config.ValidationConfig{
+				Required: []string{colMsgID},
+				Enums:    map[string][]string{colClass: {"alarm", "warning"}},
+				Ranges:   map[string]config.RangeRule{colLevel: {Min: intPtr(0), Max: intPtr(5)}},
+				Patterns: map[string]string{colAddr: `^\d+$`},
+			},
+		},
+		{
+			name:    "unknown required field",
+			cfg:     config.ValidationConfig{Required: []string{"colour"}},
+			wantErr: `unknown field "colour"`,
+		},
+		{
+			name:    "unknown enum field",
+			cfg:     config.ValidationConfig{Enums: map[string][]string{"colour": {"red"}}},
+			wantErr: `unknown field "colour"`,
+		},
+		{
+			name:    "invalid pattern",
+			cfg:     config.ValidationConfig{Patterns: map[string]string{colAddr: `(`}},
+			wantErr: "invalid pattern for addr",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRules(tt.cfg)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRulesCheck(t *testing.T) {
+	rules, err := NewRules(config.ValidationConfig{
+		Required:   []string{colMsgID, colText},
+		Enums:      map[string][]string{colClass: {"Alarm", "Warning"}},
+		IgnoreCase: true,
+		Ranges: map[string]config.RangeRule{
+			colLevel: {Min: intPtr(0), Max: intPtr(5)},
+			colBit:   {Min: intPtr(0)},
+		},
+		Patterns: map[string]string{colArea: `^(HR|IR|I|C)$`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := map[string]string{
+		colMsgID: "M1",
+		colText:  "overheat",
+		colClass: "alarm",
+		colLevel: "3",
+		colBit:   "7",
+		colArea:  "HR",
+	}
+	tests := []struct {
+		name   string
+		change map[string]string
+		want   [][2]string // column and code of every violation, in order
+	}{
+		{name: "valid row"},
+		{
+			name:   "enum is case-insensitive and trimmed",
+			change: map[string]string{colClass: " WARNING "},
+		},
+		{
+			name:   "empty optional values are not checked",
+			change: map[string]string{colClass: "", colLevel: " ", colArea: ""},
+		},
+		{
+			name:   "missing required values",
+			change: map[string]string{colMsgID: "", colText: "  "},
+			want:   [][2]string{{colMsgID, models.ErrCodeMissingValue}, {colText, models.ErrCodeMissingValue}},
+		},
+		{
+			name:   "value not in enum",
+			change: map[string]string{colClass: "info"},
+			want:   [][2]string{{colClass, models.ErrCodeBadEnum}},
+		},
+		{
+			name:   "not a number",
+			change: map[string]string{colLevel: "high"},
+			want:   [][2]string{{colLevel, models.ErrCodeBadNumber}},
+		},
+		{
+			name:   "above max",
+			change: map[string]string{colLevel: "6"},
+			want:   [][2]string{{colLevel, models.ErrCodeOutOfRange}},
+		},
+		{
+			name:   "below min with open max",
+			change: map[string]string{colBit: "-1"},
+			want:   [][2]string{{colBit, models.ErrCodeOutOfRange}},
+		},
+		{
+			name:   "pattern mismatch",
+			change: map[string]string{colArea: "XX"},
+			want:   [][2]string{{colArea, models.ErrCodeBadFormat}},
+		},
+		{
+			name:   "every broken rule is reported, by field name",
+			change: map[string]string{colText: "", colLevel: "9", colArea: "Q", colClass: "debug"},
+			want: [][2]string{
+				{colText, models.ErrCodeMissingValue},
+				{colArea, models.ErrCodeBadFormat},
+				{colClass, models.ErrCodeBadEnum},
+				{colLevel, models.ErrCodeOutOfRange},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			row := make(map[string]string, len(valid))
+			for k, v := range valid {
+				row[k] = v
+			}
+			for k, v := range tt.change {
+				row[k] = v
+			}
+
+			var got [][2]string
+			for _, v := range rules.check(func(col string) string { return row[col] }) {
+				got = append(got, [2]string{v.column, v.code})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("violations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRulesEmpty(t *testing.T) {
+	var nilRules *Rules
+	if !nilRules.Empty() || nilRules.check(func(string) string { return "" }) != nil {
+		t.Error("nil rules must be empty and accept every row")
+	}
+
+	rules, err := NewRules(config.ValidationConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rules.Empty() {
+		t.Error("rules without fields must be empty")
+	}
+}
+
+func TestFormatRange(t *testing.T) {
+	tests := []struct {
+		rng  config.RangeRule
+		want string
+	}{
+		{config.RangeRule{Min: intPtr(0), Max: intPtr(5)}, "[0, 5]"},
+		{config.RangeRule{Min: intPtr(1)}, "[1, ..]"},
+		{config.RangeRule{Max: intPtr(-1)}, "[.., -1]"},
+	}
+	for _, tt := range tests {
+		if got := formatRange(tt.rng); got != tt.want {
+			t.Errorf("formatRange(%v) = %q, want %q", tt.rng, got, tt.want)
+		}
+	}
+}
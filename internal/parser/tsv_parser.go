@@ -3,10 +3,13 @@ package parser
 import (
 	"biocad-tsv-service/internal/models"
 	"biocad-tsv-service/internal/repository"
+	"biocad-tsv-service/internal/util"
 	"context"
 	"encoding/csv"
 	"fmt"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"io"
 	"log"
 	"os"
@@ -15,33 +18,66 @@ import (
 	"time"
 )
 
-// column indexes in TSV file
-const (
-	colMQTT      = 0
-	colN         = 1
-	colUnitGUID  = 2
-	colMsgID     = 3
-	colText      = 4
-	colContext   = 5
-	colClass     = 6
-	colLevel     = 7
-	colArea      = 8
-	colAddr      = 9
-	colBlock     = 10
-	colType      = 11
-	colBit       = 12
-	colInvertBit = 13
-	expectedCols = 14
-)
+// Options controls how a file is ingested
+type Options struct {
+	// Strict discards every message of a file if any of its rows fails,
+	// otherwise the valid rows are kept and the broken ones are recorded
+	Strict bool
+	// BatchSize is the number of messages written per COPY
+	BatchSize int
+	// Rules are the configured field validation rules, nil disables them
+	Rules *Rules
+	// NaturalKey identifies a message of a unit across files
+	NaturalKey repository.NaturalKey
+	// Upsert merges the messages of a file into the stored ones by NaturalKey, otherwise they are appended
+	Upsert bool
+	// DeleteMissing deletes, in upsert mode, the stored messages of the file's units that the file doesn't contain.
+	// Files with broken rows delete nothing.
+	DeleteMissing bool
+}
+
+// Result is the outcome of ingesting one file
+type Result struct {
+	FileID   uuid.UUID // processed_files row of the content
+	Status   string    // success / failed
+	Skipped  bool      // the content was processed before, nothing was written
+	Messages []*models.Message
+}
 
-// ParseTSVFile reads a TSV file and stores messages into the database
+// position locates a record in the file
+type position struct {
+	line   int   // 1-based line number
+	offset int64 // byte offset of the start of the record
+}
+
+// pendingMessage is a parsed message waiting for the next batch, with the record it came from
+type pendingMessage struct {
+	msg    *models.Message
+	record []string
+	pos    position
+}
+
+// rowErrorFunc records a broken row. column is empty when the whole row is broken.
+type rowErrorFunc func(pos position, record []string, column, code, text string)
+
+// ParseTSVFile reads a TSV file and stores messages into the database.
+// Files are identified by content: a file whose content is already processed is skipped
+// and the result of the earlier run is returned with Skipped set. Columns are mapped by name when the first line is a header,
+// otherwise by position.
+// Messages are written in batches of opts.BatchSize with COPY. Messages, parse errors
+// and the processed_files row of the file are committed in one transaction.
+// With opts.Upsert the batches go to a staging table and are merged into the stored messages at the end.
+// Every unit of the stored messages gets a new revision in the unit history.
 func ParseTSVFile(
 	ctx context.Context,
 	filePath string,
+	db *pgxpool.Pool,
 	msgRepo *repository.MessageRepo,
 	pfRepo *repository.ProcessedFileRepo,
 	errRepo *repository.ParseErrorRepo,
-) ([]*models.Message, error) {
+	revRepo *repository.RevisionRepo,
+	opts Options,
+) (*Result, error) {
 
 	f, err := os.Open(filePath)
 	if err != nil {
@@ -53,110 +89,345 @@ func ParseTSVFile(
 		}
 	}()
 
+	// the file is identified by its content, hashed from the same handle that is parsed below
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file %s: %w", filePath, err)
+	}
+	contentHash, err := util.HashReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash file %s: %w", filePath, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind file %s: %w", filePath, err)
+	}
+
 	reader := csv.NewReader(f)
 	reader.Comma = '\t'
 	reader.FieldsPerRecord = -1 // allow variable number of columns
 
+	// visible to pollers of the file status while the transaction below is open
+	if err := pfRepo.MarkParsing(ctx, &models.ProcessedFile{
+		Filename:    filePath,
+		ContentHash: contentHash,
+		Size:        info.Size(),
+		MTime:       info.ModTime(),
+	}); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction for %s: %w", filePath, err)
+	}
+	defer func() {
+		// no-op once the transaction is committed
+		_ = tx.Rollback(ctx)
+	}()
+
+	// a copy of the same content under another name may be ingested concurrently,
+	// the lock makes the second one wait and then see the first one's result
+	txPFRepo := pfRepo.WithTx(tx)
+	if err := txPFRepo.LockContent(ctx, contentHash); err != nil {
+		return nil, err
+	}
+	previous, err := txPFRepo.GetByHash(ctx, contentHash)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil && (previous.Finished() || previous.Status == models.FileStatusPurged) {
+		log.Printf("content of %s (sha256 %s) is already processed, skipping", filePath, contentHash)
+		return &Result{FileID: previous.ID, Status: previous.Status, Skipped: true}, nil
+	}
+
+	// messages and parse errors link to the row of the content, so they can be deleted with it
+	fileID := uuid.New()
+	if previous != nil {
+		fileID = previous.ID
+	}
+
+	// in upsert mode the messages are staged first, the table must outlive the savepoint below
+	writeRepo := msgRepo
+	if opts.Upsert {
+		if writeRepo, err = msgRepo.WithTx(tx).Staging(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	// messages are written under a savepoint, so strict mode can drop them and still keep the errors
+	msgTx, err := tx.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create savepoint for %s: %w", filePath, err)
+	}
+
+	batchSize := opts.BatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
 	var hadErrors bool
+	var rowCount int
 	var processedMessages []*models.Message
+	var parseErrors []*models.ParseError
+	var cols *layout
+	batch := make([]pendingMessage, 0, batchSize)
+
+	// parse errors are buffered and written after the messages,
+	// because anything written while the savepoint is open is rolled back with it
+	rowError := func(pos position, record []string, column, code, text string) {
+		hadErrors = true
+		parseErrors = append(parseErrors, &models.ParseError{
+			ID:         uuid.New(),
+			FileID:     &fileID,
+			Filename:   filePath,
+			LineNumber: pos.line,
+			ByteOffset: pos.offset,
+			ColumnName: column,
+			ErrorCode:  code,
+			RawLine:    strings.Join(record, "\t"),
+			ErrorText:  text,
+			CreatedAt:  time.Now(),
+		})
+	}
+
+	// flush writes the batch and records the rows the database rejected
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		inserted, err := insertBatch(ctx, msgTx, writeRepo, batch, opts.Strict, rowError)
+		if err != nil {
+			return err
+		}
+		processedMessages = append(processedMessages, inserted...)
+		batch = batch[:0]
+		return nil
+	}
 
 	for {
+		// the record starts where the previous one ended
+		offset := reader.InputOffset()
 		record, err := reader.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return processedMessages, fmt.Errorf("failed to read record from TSV file %s: %w", filePath, err)
+			return nil, fmt.Errorf("failed to read record from TSV file %s: %w", filePath, err)
+		}
+		line, _ := reader.FieldPos(0)
+		pos := position{line: line, offset: offset}
+
+		// the first line decides the layout: a header maps columns by name,
+		// otherwise the positional layout is used
+		if cols == nil {
+			header, isHeader, err := detectHeader(record)
+			if err != nil {
+				rowError(pos, record, "", models.ErrCodeBadHeader, fmt.Sprintf("invalid header: %v", err))
+				break
+			}
+			if isHeader {
+				cols = header
+				continue
+			}
+			cols = positionalLayout()
 		}
+		rowCount++
 
-		if len(record) < expectedCols {
+		if len(record) < cols.minCols {
 			// if the line is too short, save the error
-			hadErrors = true
-			_ = errRepo.Insert(ctx, &models.ParseError{
-				ID:        uuid.New(),
-				Filename:  filePath,
-				RawLine:   strings.Join(record, "\t"),
-				ErrorText: fmt.Sprintf("not enough columns, expected %d got %d", expectedCols, len(record)),
-				CreatedAt: time.Now(),
-			})
+			rowError(pos, record, "", models.ErrCodeTooFewColumns,
+				fmt.Sprintf("not enough columns, expected %d got %d", cols.minCols, len(record)))
 			continue
 		}
 
 		// parse unit GUID
-		unitGUID, err := uuid.Parse(record[colUnitGUID])
+		unitGUID, err := uuid.Parse(cols.value(record, colUnitGUID))
 		if err != nil {
-			hadErrors = true
-			_ = errRepo.Insert(ctx, &models.ParseError{
-				ID:        uuid.New(),
-				Filename:  filePath,
-				RawLine:   strings.Join(record, "\t"),
-				ErrorText: fmt.Sprintf("invalid unit_guid value: %v", err),
-				CreatedAt: time.Now(),
-			})
+			rowError(pos, record, colUnitGUID, models.ErrCodeBadUUID, fmt.Sprintf("invalid unit_guid value: %v", err))
 			continue
 		}
 
 		// parse level safety
-		level, err := strconv.Atoi(record[colLevel])
+		level, err := strconv.Atoi(cols.value(record, colLevel))
 		if err != nil {
-			hadErrors = true
-			_ = errRepo.Insert(ctx, &models.ParseError{
-				ID:        uuid.New(),
-				Filename:  filePath,
-				RawLine:   strings.Join(record, "\t"),
-				ErrorText: fmt.Sprintf("invalid level value: %v", err),
-				CreatedAt: time.Now(),
-			})
+			rowError(pos, record, colLevel, models.ErrCodeBadLevel, fmt.Sprintf("invalid level value: %v", err))
+			continue
+		}
+
+		// configured validation rules, every broken rule of the row is recorded
+		violations := opts.Rules.check(func(col string) string { return cols.value(record, col) })
+		for _, v := range violations {
+			rowError(pos, record, v.column, v.code, v.text)
+		}
+		if len(violations) > 0 {
+			continue
+		}
+
+		// in strict mode nothing of this file is kept anymore, only the errors are collected
+		if opts.Strict && hadErrors {
 			continue
 		}
 
 		msg := &models.Message{
 			ID:        uuid.New(),
-			MQTT:      record[colMQTT],
+			MQTT:      cols.value(record, colMQTT),
 			UnitGUID:  unitGUID,
-			MsgId:     record[colMsgID],
-			Text:      record[colText],
-			Context:   record[colContext],
-			Class:     record[colClass],
+			MsgId:     cols.value(record, colMsgID),
+			Text:      cols.value(record, colText),
+			Context:   cols.value(record, colContext),
+			Class:     cols.value(record, colClass),
 			Level:     level,
-			Area:      record[colArea],
-			Addr:      record[colAddr],
-			Block:     emptyToNil(record[colBlock]),
-			Type:      record[colType],
-			Bit:       emptyToNil(record[colBit]),
-			InvertBit: emptyToNil(record[colInvertBit]),
+			Area:      cols.value(record, colArea),
+			Addr:      cols.value(record, colAddr),
+			Block:     emptyToNil(cols.value(record, colBlock)),
+			Type:      cols.value(record, colType),
+			Bit:       emptyToNil(cols.value(record, colBit)),
+			InvertBit: emptyToNil(cols.value(record, colInvertBit)),
 			CreatedAt: time.Now(),
+
+			SourceFileID: &fileID,
+			SourceLine:   &pos.line,
+		}
+
+		batch = append(batch, pendingMessage{msg: msg, record: record, pos: pos})
+		if len(batch) >= batchSize {
+			if err := flush(); err != nil {
+				return nil, fmt.Errorf("failed to write messages of %s: %w", filePath, err)
+			}
 		}
+	}
+
+	if !opts.Strict || !hadErrors {
+		if err := flush(); err != nil {
+			return nil, fmt.Errorf("failed to write messages of %s: %w", filePath, err)
+		}
+	}
+
+	if opts.Strict && hadErrors {
+		if err := msgTx.Rollback(ctx); err != nil {
+			return nil, fmt.Errorf("failed to roll back messages of %s: %w", filePath, err)
+		}
+		processedMessages = nil
+	} else {
+		if err := msgTx.Commit(ctx); err != nil {
+			return nil, fmt.Errorf("failed to release savepoint for %s: %w", filePath, err)
+		}
+		if opts.Upsert {
+			// a broken row may be a message the units still have, so a file with errors deletes nothing
+			deleteMissing := opts.DeleteMissing && !hadErrors
+			if opts.DeleteMissing && hadErrors {
+				log.Printf("file %s has broken rows, messages of its units missing from it are kept", filePath)
+			}
+			merged, err := writeRepo.Upsert(ctx, opts.NaturalKey, deleteMissing)
+			if err != nil {
+				return nil, fmt.Errorf("failed to merge messages of %s: %w", filePath, err)
+			}
+			log.Printf("merged messages of %s: %d inserted, %d updated, %d unchanged, %d deleted, %d repeated deleted",
+				filePath, merged.Inserted, merged.Updated, merged.Unchanged, merged.Deleted, merged.Repeated)
+
+			// the lines whose key is repeated later in the file were not stored
+			if processedMessages, err = opts.NaturalKey.Dedupe(processedMessages); err != nil {
+				return nil, fmt.Errorf("failed to deduplicate messages of %s: %w", filePath, err)
+			}
+		}
+	}
+
+	revisions, err := revRepo.WithTx(tx).Record(ctx, fileID, processedMessages, opts.NaturalKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record unit revisions of %s: %w", filePath, err)
+	}
+	for _, rev := range revisions {
+		log.Printf("unit %s revision %d from %s: %d messages", rev.UnitGUID, rev.Revision, filePath, rev.MessageCount)
+	}
 
-		if err := msgRepo.Insert(ctx, msg); err != nil {
-			hadErrors = true
-			_ = errRepo.Insert(ctx, &models.ParseError{
-				ID:        uuid.New(),
-				Filename:  filePath,
-				RawLine:   strings.Join(record, "\t"),
-				ErrorText: fmt.Sprintf("database insert failed: %v", err),
-				CreatedAt: time.Now(),
-			})
-		} else {
-			processedMessages = append(processedMessages, msg)
+	txErrRepo := errRepo.WithTx(tx)
+	for _, pe := range parseErrors {
+		if err := txErrRepo.Insert(ctx, pe); err != nil {
+			return nil, fmt.Errorf("failed to save parse error for %s: %w", filePath, err)
 		}
 	}
 
-	status := "success"
+	status := models.FileStatusSuccess
 	if hadErrors {
-		status = "failed"
+		status = models.FileStatusFailed
 	}
 
-	if err := pfRepo.Insert(ctx, &models.ProcessedFile{
-		ID:          uuid.New(),
-		Filename:    filePath,
-		ProcessedAt: time.Now(),
-		Status:      status,
-	}); err != nil {
-		log.Printf("failed to mark file %s as processed: %v", filePath, err)
+	pf := &models.ProcessedFile{
+		ID:           fileID,
+		Filename:     filePath,
+		ContentHash:  contentHash,
+		Size:         info.Size(),
+		MTime:        info.ModTime(),
+		ProcessedAt:  time.Now(),
+		Status:       status,
+		RowCount:     rowCount,
+		MessageCount: len(processedMessages),
+		ErrorCount:   len(parseErrors),
+	}
+	if err := txPFRepo.Insert(ctx, pf); err != nil {
+		return nil, fmt.Errorf("failed to mark file %s as processed: %w", filePath, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit file %s: %w", filePath, err)
+	}
+
+	return &Result{FileID: pf.ID, Status: status, Messages: processedMessages}, nil
+}
+
+// insertBatch writes the batch with one COPY under a savepoint. If the COPY fails, the savepoint is
+// rolled back and the rows are inserted one by one to find the broken ones, which are passed to rowError.
+// In strict mode the row by row retry stops at the first broken row, since nothing will be kept anyway.
+// The returned error is set only when the transaction itself can't be used anymore.
+func insertBatch(
+	ctx context.Context,
+	tx pgx.Tx,
+	msgRepo *repository.MessageRepo,
+	batch []pendingMessage,
+	strict bool,
+	rowError rowErrorFunc,
+) ([]*models.Message, error) {
+	msgs := make([]*models.Message, 0, len(batch))
+	for _, p := range batch {
+		msgs = append(msgs, p.msg)
 	}
 
-	return processedMessages, nil
+	batchTx, err := tx.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := msgRepo.WithTx(batchTx).InsertBatch(ctx, msgs); err == nil {
+		if err := batchTx.Commit(ctx); err != nil {
+			return nil, err
+		}
+		return msgs, nil
+	}
+	if err := batchTx.Rollback(ctx); err != nil {
+		return nil, err
+	}
+
+	inserted := make([]*models.Message, 0, len(batch))
+	for _, p := range batch {
+		rowTx, err := tx.Begin(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := msgRepo.WithTx(rowTx).Insert(ctx, p.msg); err != nil {
+			if rbErr := rowTx.Rollback(ctx); rbErr != nil {
+				return nil, rbErr
+			}
+			rowError(p.pos, p.record, "", models.ErrCodeDBInsert, fmt.Sprintf("database insert failed: %v", err))
+			if strict {
+				return nil, nil
+			}
+			continue
+		}
+		if err := rowTx.Commit(ctx); err != nil {
+			return nil, err
+		}
+		inserted = append(inserted, p.msg)
+	}
+	return inserted, nil
 }
 
 func emptyToNil(value string) *string {
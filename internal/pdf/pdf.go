@@ -1,27 +1,52 @@
 package pdf
 
 import (
+	"biocad-tsv-service/internal/models"
 	"biocad-tsv-service/internal/repository"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/phpdave11/gofpdf"
 )
 
-// GenerateUnitPDF creates a PDF file with unitGUID data
-func GenerateUnitPDF(ctx context.Context, outDir string, unitGUID uuid.UUID, msgRepo *repository.MessageRepo) error {
+// ErrNoMessages is returned by GenerateUnitPDF when the unit has no messages to report
+var ErrNoMessages = errors.New("no messages found")
+
+// GenerateUnitPDF creates a PDF file with unitGUID data.
+// Each message refers to its source file and line, the files are listed below the table.
+// The changes the latest revision of the unit made to the previous one follow, matched by the natural key.
+func GenerateUnitPDF(
+	ctx context.Context,
+	outDir string,
+	unitGUID uuid.UUID,
+	msgRepo *repository.MessageRepo,
+	pfRepo *repository.ProcessedFileRepo,
+	revRepo *repository.RevisionRepo,
+	key repository.NaturalKey,
+) error {
 	messages, err := msgRepo.GetByUnitGUID(ctx, unitGUID)
 	if err != nil {
 		return fmt.Errorf("failed to get messages for unit %s: %w", unitGUID, err)
 	}
 	if len(messages) == 0 {
-		return fmt.Errorf("no messages found for unit %s", unitGUID)
+		return fmt.Errorf("%w for unit %s", ErrNoMessages, unitGUID)
+	}
+	sources, err := sourceFiles(ctx, messages, pfRepo)
+	if err != nil {
+		return fmt.Errorf("failed to get source files for unit %s: %w", unitGUID, err)
+	}
+	diff, err := latestDiff(ctx, unitGUID, revRepo, key)
+	if err != nil {
+		return fmt.Errorf("failed to compare revisions of unit %s: %w", unitGUID, err)
 	}
 
-	pdf := gofpdf.New("P", "mm", "A4", "")
+	// landscape, the table is wider than the 190mm a portrait page leaves between the margins
+	pdf := gofpdf.New("L", "mm", "A4", "")
 	pdf.SetTitle(fmt.Sprintf("Unit %s Report", unitGUID), false)
 	pdf.AddPage()
 
@@ -44,8 +69,9 @@ func GenerateUnitPDF(ctx context.Context, outDir string, unitGUID uuid.UUID, msg
 		"Bit",
 		"InvertBit",
 		"CreatedAt",
+		"Source",
 	}
-	colWidths := []float64{20, 40, 15, 10, 20, 20, 15, 15, 15, 20, 25}
+	colWidths := []float64{20, 80, 15, 10, 20, 20, 15, 15, 15, 20, 25, 15} // 270mm of the 277mm between the margins
 
 	for i, h := range header {
 		pdf.CellFormat(colWidths[i], 7, h, "1", 0, "C", false, 0, "")
@@ -67,6 +93,7 @@ func GenerateUnitPDF(ctx context.Context, outDir string, unitGUID uuid.UUID, msg
 			nilOrString(m.Bit),
 			nilOrString(m.InvertBit),
 			m.CreatedAt.Format("2006-01-02 15:04:05"),
+			sources.ref(m),
 		}
 		for i, v := range values {
 			pdf.CellFormat(colWidths[i], 6, v, "1", 0, "", false, 0, "")
@@ -74,6 +101,45 @@ func GenerateUnitPDF(ctx context.Context, outDir string, unitGUID uuid.UUID, msg
 		pdf.Ln(-1)
 	}
 
+	// source files legend
+	if len(sources.files) > 0 {
+		pdf.Ln(4)
+		pdf.SetFont("Arial", "B", 10)
+		pdf.Cell(0, 6, "Source files")
+		pdf.Ln(-1)
+		pdf.SetFont("Arial", "", 9)
+		for i, f := range sources.files {
+			pdf.Cell(0, 5, fmt.Sprintf("#%d  %s  (%s)", i+1, f.name, f.id))
+			pdf.Ln(-1)
+		}
+	}
+
+	// changes of the latest revision
+	if diff != nil {
+		pdf.Ln(4)
+		pdf.SetFont("Arial", "B", 10)
+		pdf.Cell(0, 6, fmt.Sprintf("Changes in revision %d since revision %d", diff.To.Revision, diff.From.Revision))
+		pdf.Ln(-1)
+		pdf.SetFont("Arial", "", 9)
+		if diff.Empty() {
+			pdf.Cell(0, 5, "No changes")
+			pdf.Ln(-1)
+		}
+		for _, v := range diff.Added {
+			pdf.MultiCell(0, 5, fmt.Sprintf("+ %s  %s", v.MsgId, v.Text), "", "", false)
+		}
+		for _, v := range diff.Removed {
+			pdf.MultiCell(0, 5, fmt.Sprintf("- %s  %s", v.MsgId, v.Text), "", "", false)
+		}
+		for _, c := range diff.Modified {
+			fields := make([]string, 0, len(c.Changes))
+			for _, f := range c.Changes {
+				fields = append(fields, fmt.Sprintf("%s: %s -> %s", f.Field, fieldString(f.From), fieldString(f.To)))
+			}
+			pdf.MultiCell(0, 5, fmt.Sprintf("~ %s  %s", c.To.MsgId, strings.Join(fields, "; ")), "", "", false)
+		}
+	}
+
 	// check the directory
 	if _, err := os.Stat(outDir); os.IsNotExist(err) {
 		if err := os.MkdirAll(outDir, 0755); err != nil {
@@ -82,7 +148,7 @@ func GenerateUnitPDF(ctx context.Context, outDir string, unitGUID uuid.UUID, msg
 	}
 
 	// saving PDF
-	filePath := filepath.Join(outDir, fmt.Sprintf("%s.pdf", unitGUID))
+	filePath := unitPDFPath(outDir, unitGUID)
 	if err := pdf.OutputFileAndClose(filePath); err != nil {
 		return fmt.Errorf("failed to save PDF: %w", err)
 	}
@@ -90,6 +156,94 @@ func GenerateUnitPDF(ctx context.Context, outDir string, unitGUID uuid.UUID, msg
 	return nil
 }
 
+// sourceFile is a file listed in the legend of the report
+type sourceFile struct {
+	id   uuid.UUID
+	name string
+}
+
+// sourceIndex numbers the source files of the messages in the order they first appear
+type sourceIndex struct {
+	files []sourceFile
+	index map[uuid.UUID]int // 1-based number in files
+}
+
+// sourceFiles looks up the source files of the messages
+func sourceFiles(ctx context.Context, messages []models.Message, pfRepo *repository.ProcessedFileRepo) (*sourceIndex, error) {
+	s := &sourceIndex{index: make(map[uuid.UUID]int)}
+	for _, m := range messages {
+		if m.SourceFileID == nil {
+			continue
+		}
+		if _, ok := s.index[*m.SourceFileID]; ok {
+			continue
+		}
+
+		name := "-"
+		f, err := pfRepo.GetByID(ctx, *m.SourceFileID)
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			name = filepath.Base(f.Filename)
+		}
+		s.files = append(s.files, sourceFile{id: *m.SourceFileID, name: name})
+		s.index[*m.SourceFileID] = len(s.files)
+	}
+	return s, nil
+}
+
+// ref is the "#file:line" reference of the message, "-" for messages ingested before they were linked to files
+func (s *sourceIndex) ref(m models.Message) string {
+	if m.SourceFileID == nil {
+		return "-"
+	}
+	ref := fmt.Sprintf("#%d", s.index[*m.SourceFileID])
+	if m.SourceLine != nil {
+		ref += fmt.Sprintf(":%d", *m.SourceLine)
+	}
+	return ref
+}
+
+// latestDiff compares the latest revision of the unit with the previous one, nil if there are less than two
+func latestDiff(
+	ctx context.Context,
+	unitGUID uuid.UUID,
+	revRepo *repository.RevisionRepo,
+	key repository.NaturalKey,
+) (*models.UnitDiff, error) {
+	to, err := revRepo.Latest(ctx, unitGUID)
+	if err != nil || to == nil || to.Revision < 2 {
+		return nil, err
+	}
+	from, err := revRepo.Get(ctx, unitGUID, to.Revision-1)
+	if err != nil || from == nil {
+		return nil, err
+	}
+	return revRepo.Diff(ctx, unitGUID, from, to, key)
+}
+
+// RemoveUnitPDF deletes the PDF of a unit that has no messages anymore, a missing PDF is not an error
+func RemoveUnitPDF(outDir string, unitGUID uuid.UUID) error {
+	if err := os.Remove(unitPDFPath(outDir, unitGUID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove PDF: %w", err)
+	}
+	return nil
+}
+
+// unitPDFPath is where the PDF of the unit is saved
+func unitPDFPath(outDir string, unitGUID uuid.UUID) string {
+	return filepath.Join(outDir, fmt.Sprintf("%s.pdf", unitGUID))
+}
+
+// fieldString formats a changed field value, "-" for an empty one
+func fieldString(v any) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprint(v)
+}
+
 // nilOrString returns the string value or "-"
 func nilOrString(s *string) string {
 	if s == nil {
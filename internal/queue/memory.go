@@ -0,0 +1,54 @@
+package queue
+
+import (
+	"context"
+)
+
+// MemoryQueue is a Queue held in process memory, jobs are lost on restart
+type MemoryQueue struct {
+	jobs chan *Job
+	qm   *Manager
+}
+
+// NewMemoryQueue creates a new MemoryQueue holding up to size jobs
+func NewMemoryQueue(size int) *MemoryQueue {
+	return &MemoryQueue{
+		jobs: make(chan *Job, size),
+		qm:   New(),
+	}
+}
+
+// Enqueue adds the file unless it is already queued, it blocks while the queue is full
+func (q *MemoryQueue) Enqueue(ctx context.Context, file, _ string) (bool, error) {
+	if !q.qm.Add(file) {
+		return false, nil
+	}
+	select {
+	case q.jobs <- &Job{File: file}:
+		return true, nil
+	case <-ctx.Done():
+		q.qm.Remove(file)
+		return false, ctx.Err()
+	}
+}
+
+// Dequeue blocks until a job is available or ctx is done
+func (q *MemoryQueue) Dequeue(ctx context.Context) (*Job, error) {
+	select {
+	case job := <-q.jobs:
+		return job, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Heartbeat is a no-op, jobs in memory have no lease
+func (q *MemoryQueue) Heartbeat(_ context.Context, _ *Job) error {
+	return nil
+}
+
+// Done lets the file be queued again
+func (q *MemoryQueue) Done(_ context.Context, job *Job, _ error) error {
+	q.qm.Remove(job.File)
+	return nil
+}
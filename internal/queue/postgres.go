@@ -0,0 +1,98 @@
+package queue
+
+import (
+	"biocad-tsv-service/internal/repository"
+	"context"
+	"log"
+	"time"
+)
+
+// jobCleanupInterval is how often finished jobs older than the retention are deleted
+const jobCleanupInterval = time.Hour
+
+// PostgresQueue is a Queue backed by the jobs table. Jobs survive restarts and several
+// service instances can share it: a job is leased to one instance at a time and is
+// claimed again by another one if its holder stops sending heartbeats.
+type PostgresQueue struct {
+	Repo         *repository.JobRepo
+	Owner        string        // identifies this instance in jobs.locked_by
+	Lease        time.Duration // how long a claimed job stays with its holder without a heartbeat
+	PollInterval time.Duration // how long Dequeue waits before looking for jobs again
+	MaxAttempts  int           // a job whose lease expired this many times is failed
+	Retention    time.Duration // how long done and failed jobs are kept
+}
+
+// NewPostgresQueue creates a new PostgresQueue
+func NewPostgresQueue(
+	repo *repository.JobRepo,
+	owner string,
+	lease, pollInterval time.Duration,
+	maxAttempts int,
+	retention time.Duration,
+) *PostgresQueue {
+	return &PostgresQueue{
+		Repo:         repo,
+		Owner:        owner,
+		Lease:        lease,
+		PollInterval: pollInterval,
+		MaxAttempts:  maxAttempts,
+		Retention:    retention,
+	}
+}
+
+// StartCleanup launches the goroutine that deletes finished jobs older than the retention
+func (q *PostgresQueue) StartCleanup(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(jobCleanupInterval)
+		defer ticker.Stop()
+		for {
+			n, err := q.Repo.DeleteFinished(ctx, q.Retention)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("[queue] failed to delete finished jobs: %v", err)
+			}
+			if n > 0 {
+				log.Printf("[queue] deleted %d finished jobs older than %s", n, q.Retention)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Enqueue adds a job unless the same content is already queued or running on any instance
+func (q *PostgresQueue) Enqueue(ctx context.Context, file, contentHash string) (bool, error) {
+	return q.Repo.Enqueue(ctx, file, contentHash)
+}
+
+// Dequeue polls the jobs table until it claims a job or ctx is done
+func (q *PostgresQueue) Dequeue(ctx context.Context) (*Job, error) {
+	for {
+		j, err := q.Repo.Claim(ctx, q.Owner, q.Lease, q.MaxAttempts)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("[queue] failed to claim job: %v", err)
+		}
+		if j != nil {
+			return &Job{ID: j.ID, File: j.Filename}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(q.PollInterval):
+		}
+	}
+}
+
+// Heartbeat extends the lease, it returns repository.ErrLeaseLost if another instance took the job over
+func (q *PostgresQueue) Heartbeat(ctx context.Context, job *Job) error {
+	return q.Repo.Heartbeat(ctx, job.ID, q.Owner, q.Lease)
+}
+
+// Done marks the job done or failed
+func (q *PostgresQueue) Done(ctx context.Context, job *Job, err error) error {
+	return q.Repo.Finish(ctx, job.ID, q.Owner, err)
+}
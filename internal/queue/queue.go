@@ -0,0 +1,24 @@
+package queue
+
+import (
+	"context"
+	"github.com/google/uuid"
+)
+
+// Job is a file handed to a worker
+type Job struct {
+	ID   uuid.UUID // row in the jobs table, zero for the in-memory queue
+	File string
+}
+
+// Queue delivers files from the scanner to the workers
+type Queue interface {
+	// Enqueue adds the file unless it is queued or being processed already and reports whether it was added
+	Enqueue(ctx context.Context, file, contentHash string) (bool, error)
+	// Dequeue blocks until a job is available or ctx is done
+	Dequeue(ctx context.Context) (*Job, error)
+	// Heartbeat tells the queue the job is still being processed
+	Heartbeat(ctx context.Context, job *Job) error
+	// Done releases the job, err is the processing error or nil
+	Done(ctx context.Context, job *Job, err error) error
+}
@@ -2,60 +2,124 @@ package queue
 
 import (
 	"biocad-tsv-service/internal/repository"
+	"biocad-tsv-service/internal/util"
 	"context"
 	"log"
+	"os"
 	"path/filepath"
 	"time"
 )
 
+// DoneSuffix marks a file as completely written: data.tsv is complete once data.tsv.done exists
+const DoneSuffix = ".done"
+
 // Scanner periodically scans a directory for new TSV files
 type Scanner struct {
 	InputDir string
 	PFRepo   *repository.ProcessedFileRepo
-	Queue    chan<- string
-	QM       *Manager
+	Queue    Queue
 	Interval time.Duration
+
+	// QuietPeriod is how long size and mtime of a file must stay unchanged before it is queued,
+	// zero queues files as soon as they are seen
+	QuietPeriod time.Duration
+	// RequireDoneMarker queues only files that have a DoneSuffix sidecar
+	RequireDoneMarker bool
+
+	// known caches what was seen of a file, it is hashed again only when its size or mtime changes
+	known map[string]fileState
+	// pending are files that are still being written, they are rechecked every quiet period
+	pending map[string]struct{}
+	// intervals passes a new Interval set by SetInterval to the running scanner
+	intervals chan time.Duration
+}
+
+// fileState is what the scanner remembers about a file between scans
+type fileState struct {
+	size  int64
+	mtime time.Time
+	since time.Time // when this size and mtime were first seen
+	hash  string    // empty until the file is stable
 }
 
 // NewScanner creates a new Scanner
 func NewScanner(
 	inputDir string,
 	pfRepo *repository.ProcessedFileRepo,
-	queue chan<- string,
-	qm *Manager,
+	queue Queue,
 	interval time.Duration,
+	quietPeriod time.Duration,
+	requireDoneMarker bool,
 ) *Scanner {
 	return &Scanner{
-		InputDir: inputDir,
-		PFRepo:   pfRepo,
-		Queue:    queue,
-		QM:       qm,
-		Interval: interval,
+		InputDir:          inputDir,
+		PFRepo:            pfRepo,
+		Queue:             queue,
+		Interval:          interval,
+		QuietPeriod:       quietPeriod,
+		RequireDoneMarker: requireDoneMarker,
+		known:             make(map[string]fileState),
+		pending:           make(map[string]struct{}),
+		intervals:         make(chan time.Duration, 1),
 	}
 }
 
 // Start launches the scanner goroutine
 func (s *Scanner) Start(ctx context.Context) {
-	go func() {
-		log.Println("[scanner] started")
-		ticker := time.NewTicker(s.Interval)
-		defer func() {
-			ticker.Stop()
-			log.Println("[scanner] stopped")
-		}()
-
-		// initial scan
-		s.scan(ctx)
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-ticker.C:
-				s.scan(ctx)
+	go s.run(ctx)
+}
+
+// SetInterval changes how often the running scanner lists the input directory,
+// the new interval applies from the next tick
+func (s *Scanner) SetInterval(interval time.Duration) {
+	// a newer value replaces one the scanner hasn't picked up yet
+	select {
+	case <-s.intervals:
+	default:
+	}
+	s.intervals <- interval
+}
+
+// run scans the input directory every Interval until ctx is done
+func (s *Scanner) run(ctx context.Context) {
+	log.Println("[scanner] started")
+	ticker := time.NewTicker(s.Interval)
+	recheck, stopRecheck := s.pendingTicker()
+	defer func() {
+		ticker.Stop()
+		stopRecheck()
+		log.Println("[scanner] stopped")
+	}()
+
+	// initial scan
+	s.scan(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.scan(ctx)
+		case interval := <-s.intervals:
+			if interval != s.Interval {
+				log.Printf("[scanner] scan interval changed from %s to %s", s.Interval, interval)
+				s.Interval = interval
+				ticker.Reset(interval)
 			}
+		case <-recheck:
+			s.recheckPending(ctx)
 		}
-	}()
+	}
+}
+
+// pendingTicker ticks every quiet period to recheck the pending files.
+// The channel is nil, and never fires, when there is no quiet period.
+func (s *Scanner) pendingTicker() (<-chan time.Time, func()) {
+	if s.QuietPeriod <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTicker(s.QuietPeriod)
+	return t.C, t.Stop
 }
 
 // scan performs a single scan of the input directory
@@ -66,6 +130,18 @@ func (s *Scanner) scan(ctx context.Context) {
 		return
 	}
 
+	present := make(map[string]struct{}, len(files))
+	for _, file := range files {
+		present[file] = struct{}{}
+	}
+	// forget files that are gone
+	for file := range s.known {
+		if _, ok := present[file]; !ok {
+			delete(s.known, file)
+			delete(s.pending, file)
+		}
+	}
+
 	for _, file := range files {
 		select {
 		case <-ctx.Done():
@@ -73,14 +149,98 @@ func (s *Scanner) scan(ctx context.Context) {
 		default:
 		}
 
-		processed, err := s.PFRepo.IsProcessed(ctx, file)
-		if err != nil || processed {
-			continue
+		s.enqueue(ctx, file, false)
+	}
+}
+
+// recheckPending tries to queue the files that were still changing on the last look
+func (s *Scanner) recheckPending(ctx context.Context) {
+	for file := range s.pending {
+		s.enqueue(ctx, file, false)
+	}
+}
+
+// enqueue queues the file unless it is still being written, its content is already processed,
+// waits for its next retry or is queued already. complete skips the stability check, for files known to be written
+// completely such as ones renamed into the directory.
+func (s *Scanner) enqueue(ctx context.Context, file string, complete bool) {
+	info, err := os.Stat(file)
+	if err != nil {
+		delete(s.known, file)
+		delete(s.pending, file)
+		if !os.IsNotExist(err) {
+			log.Printf("[scanner] failed to stat %s: %v", file, err)
 		}
+		return
+	}
+
+	if !complete && !s.isStable(file, info) {
+		s.pending[file] = struct{}{}
+		return
+	}
+	delete(s.pending, file)
+
+	hash, err := s.contentHash(file, info)
+	if err != nil {
+		log.Printf("[scanner] failed to hash %s: %v", file, err)
+		return
+	}
+
+	// identical content is skipped whatever the file is called now,
+	// changed content under an old name is a new file
+	due, err := s.PFRepo.IsDue(ctx, hash)
+	if err != nil || !due {
+		return
+	}
 
-		if s.QM.Add(file) {
-			log.Printf("[scanner] queueing new file %s", file)
-			s.Queue <- file
+	added, err := s.Queue.Enqueue(ctx, file, hash)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("[scanner] failed to queue %s: %v", file, err)
 		}
+		return
+	}
+	if added {
+		log.Printf("[scanner] queued new file %s", file)
+	}
+}
+
+// isStable reports whether the file is completely written: it has a done marker,
+// or its size and mtime have not changed for the quiet period
+func (s *Scanner) isStable(file string, info os.FileInfo) bool {
+	if _, err := os.Stat(file + DoneSuffix); err == nil {
+		return true
+	}
+	if s.RequireDoneMarker {
+		return false
+	}
+	if s.QuietPeriod <= 0 {
+		return true
+	}
+
+	st, ok := s.known[file]
+	if !ok || st.size != info.Size() || !st.mtime.Equal(info.ModTime()) {
+		s.known[file] = fileState{size: info.Size(), mtime: info.ModTime(), since: time.Now()}
+		return false
+	}
+	return time.Since(st.since) >= s.QuietPeriod
+}
+
+// contentHash returns the SHA-256 of the file, reusing the cached one if the file hasn't changed
+func (s *Scanner) contentHash(file string, info os.FileInfo) (string, error) {
+	st, ok := s.known[file]
+	if ok && st.hash != "" && st.size == info.Size() && st.mtime.Equal(info.ModTime()) {
+		return st.hash, nil
+	}
+
+	hash, err := util.HashFile(file)
+	if err != nil {
+		return "", err
+	}
+	if !ok || st.size != info.Size() || !st.mtime.Equal(info.ModTime()) {
+		st = fileState{size: info.Size(), mtime: info.ModTime(), since: time.Now()}
 	}
+	st.hash = hash
+	s.known[file] = st
+	return hash, nil
 }
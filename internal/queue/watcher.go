@@ -0,0 +1,117 @@
+package queue
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Watcher queues TSV files as soon as they are written or moved into the input directory.
+// It feeds the same Manager and queue as the Scanner it wraps and uses it for the initial scan,
+// for the periodic safety rescans and as the fallback when the event source is unavailable.
+type Watcher struct {
+	Scanner        *Scanner
+	RescanInterval time.Duration
+
+	// intervals passes a new RescanInterval set by SetRescanInterval to the running watcher
+	intervals chan time.Duration
+}
+
+// dirEvent is a file that changed in the watched directory
+type dirEvent struct {
+	name    string // base name, empty when events were lost and the whole directory has to be scanned
+	movedIn bool   // the file was renamed into the directory
+}
+
+// NewWatcher creates a new Watcher
+func NewWatcher(scanner *Scanner, rescanInterval time.Duration) *Watcher {
+	return &Watcher{
+		Scanner:        scanner,
+		RescanInterval: rescanInterval,
+		intervals:      make(chan time.Duration, 1),
+	}
+}
+
+// SetRescanInterval changes how often the running watcher rescans the input directory,
+// the new interval applies from the next tick
+func (w *Watcher) SetRescanInterval(interval time.Duration) {
+	// a newer value replaces one the watcher hasn't picked up yet
+	select {
+	case <-w.intervals:
+	default:
+	}
+	w.intervals <- interval
+}
+
+// Start launches the watcher goroutine. It returns an error if the directory can't be watched,
+// in which case the caller is expected to fall back to the polling Scanner.
+func (w *Watcher) Start(ctx context.Context) error {
+	events, err := watchDir(ctx, w.Scanner.InputDir)
+	if err != nil {
+		return err
+	}
+	go w.run(ctx, events)
+	return nil
+}
+
+// run handles directory events until ctx is done
+func (w *Watcher) run(ctx context.Context, events <-chan dirEvent) {
+	log.Printf("[watcher] watching %s", w.Scanner.InputDir)
+	ticker := time.NewTicker(w.RescanInterval)
+	recheck, stopRecheck := w.Scanner.pendingTicker()
+	defer func() {
+		ticker.Stop()
+		stopRecheck()
+	}()
+
+	// files that arrived before the watch was set up
+	w.Scanner.scan(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("[watcher] stopped")
+			return
+		case <-ticker.C:
+			w.Scanner.scan(ctx)
+		case interval := <-w.intervals:
+			if interval != w.RescanInterval {
+				log.Printf("[watcher] rescan interval changed from %s to %s", w.RescanInterval, interval)
+				w.RescanInterval = interval
+				ticker.Reset(interval)
+			}
+		case <-recheck:
+			w.Scanner.recheckPending(ctx)
+		case ev, ok := <-events:
+			if !ok {
+				log.Println("[watcher] event source closed, falling back to polling")
+				w.Scanner.run(ctx)
+				return
+			}
+			w.handle(ctx, ev)
+		}
+	}
+}
+
+// handle queues the file an event is about
+func (w *Watcher) handle(ctx context.Context, ev dirEvent) {
+	if ev.name == "" {
+		log.Println("[watcher] event queue overflowed, rescanning")
+		w.Scanner.scan(ctx)
+		return
+	}
+
+	// a done marker appearing completes the file it belongs to,
+	// the stability check finds the marker
+	name := strings.TrimSuffix(ev.name, DoneSuffix)
+	if match, _ := filepath.Match("*.tsv", name); !match {
+		return
+	}
+
+	// a file renamed into the directory (e.g. from data.tsv.tmp) was written completely beforehand,
+	// unless the done marker is required anyway
+	complete := ev.movedIn && name == ev.name && !w.Scanner.RequireDoneMarker
+	w.Scanner.enqueue(ctx, filepath.Join(w.Scanner.InputDir, name), complete)
+}
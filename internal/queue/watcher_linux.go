@@ -0,0 +1,82 @@
+//go:build linux
+
+package queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+)
+
+// watchMask selects files that are complete: closed after writing or moved into the directory
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO
+
+// watchDir starts watching dir with inotify and sends the files that changed.
+// The channel is closed when the watch stops, which happens when ctx is done or reading fails.
+func watchDir(ctx context.Context, dir string) (<-chan dirEvent, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify init failed: %w", err)
+	}
+	if _, err := syscall.InotifyAddWatch(fd, dir, watchMask); err != nil {
+		_ = syscall.Close(fd)
+		return nil, fmt.Errorf("failed to watch %s: %w", dir, err)
+	}
+
+	// a non-blocking descriptor is served by the runtime poller, so Close unblocks Read
+	f := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		<-ctx.Done()
+		_ = f.Close()
+	}()
+
+	events := make(chan dirEvent)
+	go func() {
+		defer close(events)
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("[watcher] failed to read inotify events: %v", err)
+				}
+				return
+			}
+			for _, ev := range parseEvents(buf[:n]) {
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// parseEvents decodes raw inotify events, an overflow is returned as an event without a name
+func parseEvents(buf []byte) []dirEvent {
+	var events []dirEvent
+	for len(buf) >= syscall.SizeofInotifyEvent {
+		mask := binary.NativeEndian.Uint32(buf[4:8])
+		nameLen := int(binary.NativeEndian.Uint32(buf[12:16]))
+		end := syscall.SizeofInotifyEvent + nameLen
+		if end > len(buf) {
+			break
+		}
+
+		switch {
+		case mask&syscall.IN_Q_OVERFLOW != 0:
+			events = append(events, dirEvent{})
+		case mask&syscall.IN_ISDIR == 0 && nameLen > 0:
+			name := bytes.TrimRight(buf[syscall.SizeofInotifyEvent:end], "\x00")
+			events = append(events, dirEvent{name: string(name), movedIn: mask&syscall.IN_MOVED_TO != 0})
+		}
+		buf = buf[end:]
+	}
+	return events
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package queue
+
+import (
+	"context"
+	"errors"
+)
+
+// watchDir is only implemented on linux
+func watchDir(_ context.Context, _ string) (<-chan dirEvent, error) {
+	return nil, errors.New("directory watching is only supported on linux")
+}
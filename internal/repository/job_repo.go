@@ -0,0 +1,154 @@
+package repository
+
+import (
+	"biocad-tsv-service/internal/models"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// ErrLeaseLost is returned when a job is no longer held by the caller,
+// because its lease expired and another instance claimed it
+var ErrLeaseLost = errors.New("job lease lost")
+
+type JobRepo struct {
+	db DBTX
+}
+
+func NewJobRepo(db *pgxpool.Pool) *JobRepo {
+	return &JobRepo{db: db}
+}
+
+// Enqueue adds a queued job for the file. It reports false if the same content
+// is already queued or running, possibly queued by another instance.
+func (r *JobRepo) Enqueue(ctx context.Context, filename, contentHash string) (bool, error) {
+	tag, err := r.db.Exec(ctx, `
+		INSERT INTO "jobs" (id, filename, content_hash, status)
+		VALUES ($1,$2,$3,$4)
+		ON CONFLICT (content_hash) WHERE status IN ('queued', 'running') DO NOTHING
+	`, uuid.New(), filename, contentHash, models.JobStatusQueued)
+	if err != nil {
+		return false, fmt.Errorf("enqueue job failed: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// Claim takes the oldest queued job, or a running one whose lease expired, and leases it to owner.
+// It returns nil if there is nothing to do. Rows locked by other instances are skipped.
+// A job whose lease expired after maxAttempts claims, most likely because the file crashes the worker,
+// is failed instead and its file is marked dead, as if its ingest had failed that many times.
+func (r *JobRepo) Claim(ctx context.Context, owner string, lease time.Duration, maxAttempts int) (*models.Job, error) {
+	if err := r.failExhausted(ctx, maxAttempts); err != nil {
+		return nil, err
+	}
+
+	var j models.Job
+	err := r.db.QueryRow(ctx, `
+		UPDATE "jobs"
+		SET status=$2, locked_by=$3, lease_until=now() + make_interval(secs => $4),
+		    heartbeat_at=now(), attempts=attempts+1, updated_at=now()
+		WHERE id = (
+			SELECT id
+			FROM "jobs"
+			WHERE status=$1 OR (status=$2 AND lease_until < now() AND attempts < $5)
+			ORDER BY created_at
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING id, filename, content_hash, status, attempts, locked_by, lease_until,
+		          heartbeat_at, last_error, created_at, updated_at
+	`, models.JobStatusQueued, models.JobStatusRunning, owner, lease.Seconds(), maxAttempts).Scan(
+		&j.ID, &j.Filename, &j.ContentHash, &j.Status, &j.Attempts, &j.LockedBy, &j.LeaseUntil,
+		&j.HeartbeatAt, &j.LastError, &j.CreatedAt, &j.UpdatedAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("claim job failed: %w", err)
+	}
+	return &j, nil
+}
+
+// failExhausted fails the running jobs whose lease expired after maxAttempts claims and marks their files dead.
+// A file the scanner queued has no processed_files row until a worker starts on it, one is added then.
+func (r *JobRepo) failExhausted(ctx context.Context, maxAttempts int) error {
+	_, err := r.db.Exec(ctx, `
+		WITH exhausted AS (
+			UPDATE "jobs"
+			SET status=$3, locked_by=NULL, lease_until=NULL, updated_at=now(),
+			    last_error='lease expired after ' || attempts || ' attempts, the file may crash the worker'
+			WHERE status=$1 AND lease_until < now() AND attempts >= $2
+			RETURNING filename, content_hash, attempts, last_error
+		)
+		INSERT INTO "processed_files" (id, filename, content_hash, processed_at, status, attempts, last_error)
+		SELECT gen_random_uuid(), filename, content_hash, now(), $4, attempts, last_error
+		FROM exhausted
+		ON CONFLICT (content_hash) DO UPDATE
+		SET status = EXCLUDED.status, attempts = EXCLUDED.attempts, last_error = EXCLUDED.last_error,
+		    next_attempt_at = NULL
+		WHERE processed_files.status IN ($5, $6)
+	`, models.JobStatusRunning, maxAttempts, models.JobStatusFailed,
+		models.FileStatusDead, models.FileStatusQueued, models.FileStatusParsing)
+	if err != nil {
+		return fmt.Errorf("fail exhausted jobs failed: %w", err)
+	}
+	return nil
+}
+
+// DeleteFinished deletes the done and failed jobs last changed more than retention ago
+// and returns how many there were
+func (r *JobRepo) DeleteFinished(ctx context.Context, retention time.Duration) (int64, error) {
+	tag, err := r.db.Exec(ctx, `
+		DELETE FROM "jobs"
+		WHERE status IN ($1, $2) AND updated_at < now() - make_interval(secs => $3)
+	`, models.JobStatusDone, models.JobStatusFailed, retention.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("delete finished jobs failed: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// Heartbeat extends the lease of a running job held by owner
+func (r *JobRepo) Heartbeat(ctx context.Context, id uuid.UUID, owner string, lease time.Duration) error {
+	tag, err := r.db.Exec(ctx, `
+		UPDATE "jobs"
+		SET lease_until=now() + make_interval(secs => $4), heartbeat_at=now(), updated_at=now()
+		WHERE id=$1 AND locked_by=$2 AND status=$3
+	`, id, owner, models.JobStatusRunning, lease.Seconds())
+	if err != nil {
+		return fmt.Errorf("job heartbeat failed: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// Finish marks a job held by owner as done, or failed with lastError
+func (r *JobRepo) Finish(ctx context.Context, id uuid.UUID, owner string, lastError error) error {
+	status := models.JobStatusDone
+	var errText *string
+	if lastError != nil {
+		status = models.JobStatusFailed
+		text := lastError.Error()
+		errText = &text
+	}
+
+	tag, err := r.db.Exec(ctx, `
+		UPDATE "jobs"
+		SET status=$4, last_error=$5, locked_by=NULL, lease_until=NULL, updated_at=now()
+		WHERE id=$1 AND locked_by=$2 AND status=$3
+	`, id, owner, models.JobStatusRunning, status, errText)
+	if err != nil {
+		return fmt.Errorf("finish job failed: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
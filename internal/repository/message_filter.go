@@ -0,0 +1,101 @@
+package repository
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"strings"
+	"time"
+)
+
+// MessageFilter narrows a message query. Zero fields are not filtered on, the set ones are combined with AND.
+type MessageFilter struct {
+	UnitGUID uuid.UUID
+	MsgID    string
+	Class    string
+	Area     string
+	Addr     string
+	Type     string
+	Text     string // case-insensitive substring of the text
+
+	Level    *int // exact level
+	LevelMin *int // inclusive bounds of the level
+	LevelMax *int
+
+	CreatedFrom time.Time // inclusive
+	CreatedTo   time.Time // exclusive
+
+	SourceFileID uuid.UUID // processed_files row the messages were read from
+	SourceLine   *int      // line in the source file
+}
+
+// likeEscaper escapes the LIKE wildcards of a substring
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// MessageCursor is the position after the last message of a page in the (created_at, id) order
+type MessageCursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+// where builds the WHERE clause of the filter with positional parameters, empty when nothing is filtered.
+// A non-nil after keeps only the messages that come after the cursor, newest first.
+func (f MessageFilter) where(after *MessageCursor) (string, []any) {
+	var conds []string
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	if f.UnitGUID != uuid.Nil {
+		add("unit_guid = $%d", f.UnitGUID)
+	}
+	if f.MsgID != "" {
+		add("msg_id = $%d", f.MsgID)
+	}
+	if f.Class != "" {
+		add("class = $%d", f.Class)
+	}
+	if f.Area != "" {
+		add("area = $%d", f.Area)
+	}
+	if f.Addr != "" {
+		add("addr = $%d", f.Addr)
+	}
+	if f.Type != "" {
+		add("type = $%d", f.Type)
+	}
+	if f.Text != "" {
+		add("text ILIKE '%%' || $%d || '%%'", likeEscaper.Replace(f.Text))
+	}
+	if f.Level != nil {
+		add("level = $%d", *f.Level)
+	}
+	if f.LevelMin != nil {
+		add("level >= $%d", *f.LevelMin)
+	}
+	if f.LevelMax != nil {
+		add("level <= $%d", *f.LevelMax)
+	}
+	if !f.CreatedFrom.IsZero() {
+		add("created_at >= $%d", f.CreatedFrom)
+	}
+	if !f.CreatedTo.IsZero() {
+		add("created_at < $%d", f.CreatedTo)
+	}
+	if f.SourceFileID != uuid.Nil {
+		add("source_file_id = $%d", f.SourceFileID)
+	}
+	if f.SourceLine != nil {
+		add("source_line = $%d", *f.SourceLine)
+	}
+	if after != nil {
+		args = append(args, after.CreatedAt, after.ID)
+		conds = append(conds, fmt.Sprintf("(created_at, id) < ($%d, $%d)", len(args)-1, len(args)))
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
@@ -5,16 +5,23 @@ import (
 	"context"
 	"fmt"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"time"
 )
 
 type MessageRepo struct {
-	db *pgxpool.Pool
+	db    DBTX
+	table string // where Insert and InsertBatch write: messages, or the staging table of an upsert
 }
 
 func NewMessageRepo(db *pgxpool.Pool) *MessageRepo {
-	return &MessageRepo{db: db}
+	return &MessageRepo{db: db, table: "messages"}
+}
+
+// WithTx returns a copy of the repository that runs its queries in tx
+func (r *MessageRepo) WithTx(tx pgx.Tx) *MessageRepo {
+	return &MessageRepo{db: tx, table: r.table}
 }
 
 func (r *MessageRepo) Insert(ctx context.Context, msg *models.Message) error {
@@ -26,13 +33,14 @@ func (r *MessageRepo) Insert(ctx context.Context, msg *models.Message) error {
 	}
 
 	_, err := r.db.Exec(ctx, `
-		INSERT INTO "messages" 
+		INSERT INTO `+pgx.Identifier{r.table}.Sanitize()+` 
 		    (id, mqtt, unit_guid, msg_id, text, context, class, level, area, addr, block, 
-		     type, bit, invert_bit, created_at) 
-		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15)
+		     type, bit, invert_bit, created_at, source_file_id, source_line) 
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17)
 	`,
 		msg.ID, msg.MQTT, msg.UnitGUID, msg.MsgId, msg.Text, msg.Context, msg.Class,
 		msg.Level, msg.Area, msg.Addr, msg.Block, msg.Type, msg.Bit, msg.InvertBit, msg.CreatedAt,
+		msg.SourceFileID, msg.SourceLine,
 	)
 	if err != nil {
 		return fmt.Errorf("insert message failed: %w", err)
@@ -40,10 +48,46 @@ func (r *MessageRepo) Insert(ctx context.Context, msg *models.Message) error {
 	return nil
 }
 
+// messageCopyColumns is the column order used by InsertBatch
+var messageCopyColumns = []string{
+	"id", "mqtt", "unit_guid", "msg_id", "text", "context", "class", "level", "area", "addr", "block",
+	"type", "bit", "invert_bit", "created_at", "source_file_id", "source_line",
+}
+
+// InsertBatch writes messages with a single COPY and returns the number of rows copied.
+// COPY is all-or-nothing: if any row is rejected, none of the batch is written.
+func (r *MessageRepo) InsertBatch(ctx context.Context, msgs []*models.Message) (int64, error) {
+	rows := make([][]any, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg.ID == uuid.Nil {
+			msg.ID = uuid.New()
+		}
+		if msg.CreatedAt.IsZero() {
+			msg.CreatedAt = time.Now()
+		}
+		rows = append(rows, []any{
+			msg.ID, msg.MQTT, msg.UnitGUID, msg.MsgId, msg.Text, msg.Context, msg.Class,
+			msg.Level, msg.Area, msg.Addr, msg.Block, msg.Type, msg.Bit, msg.InvertBit, msg.CreatedAt,
+			msg.SourceFileID, msg.SourceLine,
+		})
+	}
+
+	n, err := r.db.CopyFrom(ctx, pgx.Identifier{r.table}, messageCopyColumns, pgx.CopyFromRows(rows))
+	if err != nil {
+		return 0, fmt.Errorf("copy messages failed: %w", err)
+	}
+	return n, nil
+}
+
+// messageColumns is the select list read by scanMessages
+const messageColumns = `
+	id, mqtt, unit_guid, msg_id, text, context, class,
+	level, area, addr, block, type, bit, invert_bit, created_at, source_file_id, source_line`
+
 // GetByUnitGUID returns all messages for a given device
 func (r *MessageRepo) GetByUnitGUID(ctx context.Context, unitGUID uuid.UUID) ([]models.Message, error) {
 	rows, err := r.db.Query(ctx, `
-		SELECT id, mqtt, unit_guid, msg_id, text, context, class, level, area, addr, block, type, bit, invert_bit, created_at
+		SELECT `+messageColumns+`
 		FROM "messages"
 		WHERE unit_guid=$1
 		ORDER BY created_at DESC
@@ -51,43 +95,98 @@ func (r *MessageRepo) GetByUnitGUID(ctx context.Context, unitGUID uuid.UUID) ([]
 	if err != nil {
 		return nil, fmt.Errorf("query messages failed: %w", err)
 	}
+	return scanMessages(rows)
+}
+
+// List returns the messages matching the filter, newest first, with LIMIT/OFFSET pagination
+func (r *MessageRepo) List(ctx context.Context, filter MessageFilter, limit, offset int) ([]models.Message, error) {
+	where, args := filter.where(nil)
+	args = append(args, limit, offset)
+
+	rows, err := r.db.Query(ctx, fmt.Sprintf(`
+		SELECT `+messageColumns+`
+		FROM "messages"
+		%s
+		ORDER BY created_at DESC, id DESC
+		LIMIT $%d OFFSET $%d
+	`, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, fmt.Errorf("query messages failed: %w", err)
+	}
+	return scanMessages(rows)
+}
+
+// ListAfter returns up to limit messages matching the filter that follow the cursor, newest first.
+// A nil cursor starts from the newest message. Unlike List, the cost doesn't grow with the depth of the page,
+// and rows added meanwhile don't shift the pages.
+func (r *MessageRepo) ListAfter(ctx context.Context, filter MessageFilter, after *MessageCursor, limit int) ([]models.Message, error) {
+	where, args := filter.where(after)
+	args = append(args, limit)
+
+	rows, err := r.db.Query(ctx, fmt.Sprintf(`
+		SELECT `+messageColumns+`
+		FROM "messages"
+		%s
+		ORDER BY created_at DESC, id DESC
+		LIMIT $%d
+	`, where, len(args)), args...)
+	if err != nil {
+		return nil, fmt.Errorf("query messages failed: %w", err)
+	}
+	return scanMessages(rows)
+}
+
+// Count returns the number of messages matching the filter
+func (r *MessageRepo) Count(ctx context.Context, filter MessageFilter) (int, error) {
+	where, args := filter.where(nil)
+
+	var count int
+	err := r.db.QueryRow(ctx, `
+		SELECT COUNT(*)
+		FROM "messages"
+		`+where, args...).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("count messages failed: %w", err)
+	}
+	return count, nil
+}
+
+// UnitsBySourceFile returns the units that have messages from the file
+func (r *MessageRepo) UnitsBySourceFile(ctx context.Context, fileID uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT DISTINCT unit_guid
+		FROM "messages"
+		WHERE source_file_id=$1
+	`, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("query units of file failed: %w", err)
+	}
 	defer rows.Close()
 
-	var msgs []models.Message
+	var units []uuid.UUID
 	for rows.Next() {
-		var m models.Message
-		if err := rows.Scan(
-			&m.ID, &m.MQTT, &m.UnitGUID, &m.MsgId, &m.Text, &m.Context, &m.Class, &m.Level,
-			&m.Area, &m.Addr, &m.Block, &m.Type, &m.Bit, &m.InvertBit, &m.CreatedAt,
-		); err != nil {
-			return nil, fmt.Errorf("scan message failed: %w", err)
+		var unit uuid.UUID
+		if err := rows.Scan(&unit); err != nil {
+			return nil, fmt.Errorf("scan unit failed: %w", err)
 		}
-		msgs = append(msgs, m)
+		units = append(units, unit)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("rows iteration error: %w", err)
 	}
-
-	return msgs, nil
+	return units, nil
 }
 
-func (r *MessageRepo) GetByUnitGUIDPaginated(
-	ctx context.Context,
-	unitGUID uuid.UUID,
-	limit, offset int,
-) ([]models.Message, error) {
-
-	rows, err := r.db.Query(ctx, `
-		SELECT id, mqtt, unit_guid, msg_id, text, context, class,
-		       level, area, addr, block, type, bit, invert_bit, created_at
-		FROM "messages"
-		WHERE unit_guid=$1
-		ORDER BY created_at DESC
-		LIMIT $2 OFFSET $3
-	`, unitGUID, limit, offset)
+// DeleteBySourceFile deletes the messages read from the file and returns how many there were
+func (r *MessageRepo) DeleteBySourceFile(ctx context.Context, fileID uuid.UUID) (int64, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM "messages" WHERE source_file_id=$1`, fileID)
 	if err != nil {
-		return nil, fmt.Errorf("query messages failed: %w", err)
+		return 0, fmt.Errorf("delete messages of file failed: %w", err)
 	}
+	return tag.RowsAffected(), nil
+}
+
+func scanMessages(rows pgx.Rows) ([]models.Message, error) {
 	defer rows.Close()
 
 	var msgs []models.Message
@@ -97,25 +196,15 @@ func (r *MessageRepo) GetByUnitGUIDPaginated(
 			&m.ID, &m.MQTT, &m.UnitGUID, &m.MsgId, &m.Text,
 			&m.Context, &m.Class, &m.Level,
 			&m.Area, &m.Addr, &m.Block, &m.Type,
-			&m.Bit, &m.InvertBit, &m.CreatedAt,
+			&m.Bit, &m.InvertBit, &m.CreatedAt, &m.SourceFileID, &m.SourceLine,
 		); err != nil {
 			return nil, fmt.Errorf("scan message failed: %w", err)
 		}
 		msgs = append(msgs, m)
 	}
-
-	return msgs, rows.Err()
-}
-
-func (r *MessageRepo) CountByUnitGUID(ctx context.Context, unitGUID uuid.UUID) (int, error) {
-	var count int
-	err := r.db.QueryRow(ctx, `
-		SELECT COUNT(*) 
-		FROM "messages"
-		WHERE unit_guid=$1
-	`, unitGUID).Scan(&count)
-	if err != nil {
-		return 0, fmt.Errorf("count messages failed: %w", err)
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
 	}
-	return count, nil
+
+	return msgs, nil
 }
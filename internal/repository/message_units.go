@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"biocad-tsv-service/internal/models"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// unitSummaryQuery aggregates the messages of the units selected by the filter and the paging in its %s verbs.
+// The ingest times are those of the unit's revisions: the files messages link to change on upsert and reprocess.
+// Units ingested before revisions were kept fall back to the creation times of their messages.
+const unitSummaryQuery = `
+	WITH units AS (
+		SELECT m.unit_guid, COUNT(*) AS message_count,
+		       MIN(m.created_at) AS first_created_at, MAX(m.created_at) AS last_created_at
+		FROM "messages" m
+		%s
+		GROUP BY m.unit_guid
+		ORDER BY m.unit_guid
+		%s
+	)
+	SELECT u.unit_guid, u.message_count,
+	       (SELECT jsonb_object_agg(c.class, c.n) FROM (
+	           SELECT COALESCE(class, '') AS class, COUNT(*) AS n FROM "messages" WHERE unit_guid = u.unit_guid GROUP BY 1
+	       ) c),
+	       (SELECT jsonb_object_agg(l.level, l.n) FROM (
+	           SELECT COALESCE(level::text, '') AS level, COUNT(*) AS n FROM "messages" WHERE unit_guid = u.unit_guid GROUP BY 1
+	       ) l),
+	       COALESCE(r.first_ingest_at, u.first_created_at), COALESCE(r.last_ingest_at, u.last_created_at),
+	       s.id, s.filename
+	FROM units u
+	LEFT JOIN LATERAL (
+		SELECT MIN(created_at) AS first_ingest_at, MAX(created_at) AS last_ingest_at
+		FROM "unit_revisions"
+		WHERE unit_guid = u.unit_guid
+	) r ON true
+	LEFT JOIN LATERAL (
+		SELECT f.id, f.filename
+		FROM "processed_files" f
+		WHERE f.id IN (SELECT DISTINCT source_file_id FROM "messages" WHERE unit_guid = u.unit_guid)
+		ORDER BY f.processed_at DESC, f.id
+		LIMIT 1
+	) s ON true
+	ORDER BY u.unit_guid`
+
+// ListUnits returns the units that have messages, ordered by unit_guid, with LIMIT/OFFSET pagination
+func (r *MessageRepo) ListUnits(ctx context.Context, limit, offset int) ([]models.UnitSummary, error) {
+	rows, err := r.db.Query(ctx, fmt.Sprintf(unitSummaryQuery, "", "LIMIT $1 OFFSET $2"), limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("query units failed: %w", err)
+	}
+	defer rows.Close()
+
+	var units []models.UnitSummary
+	for rows.Next() {
+		var u models.UnitSummary
+		if err := scanUnitSummary(rows, &u); err != nil {
+			return nil, fmt.Errorf("scan unit failed: %w", err)
+		}
+		units = append(units, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+	return units, nil
+}
+
+// CountUnits returns the number of units that have messages
+func (r *MessageRepo) CountUnits(ctx context.Context) (int, error) {
+	var count int
+	if err := r.db.QueryRow(ctx, `SELECT COUNT(DISTINCT unit_guid) FROM "messages"`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("count units failed: %w", err)
+	}
+	return count, nil
+}
+
+// GetUnit returns the summary of one unit, nil if it has no messages
+func (r *MessageRepo) GetUnit(ctx context.Context, unitGUID uuid.UUID) (*models.UnitSummary, error) {
+	var u models.UnitSummary
+	err := scanUnitSummary(r.db.QueryRow(ctx, fmt.Sprintf(unitSummaryQuery, "WHERE m.unit_guid=$1", ""), unitGUID), &u)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get unit failed: %w", err)
+	}
+	return &u, nil
+}
+
+func scanUnitSummary(row pgx.Row, u *models.UnitSummary) error {
+	return row.Scan(
+		&u.UnitGUID, &u.MessageCount, &u.ByClass, &u.ByLevel,
+		&u.FirstIngestAt, &u.LastIngestAt, &u.LastSourceFileID, &u.LastSourceFile,
+	)
+}
@@ -0,0 +1,225 @@
+package repository
+
+import (
+	"biocad-tsv-service/internal/models"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// messageStagingTable holds the messages of the file being ingested in upsert mode
+const messageStagingTable = "message_staging"
+
+// messageDataColumns are the message columns that come from the file, the ones a natural key can be made of
+var messageDataColumns = []string{
+	"mqtt", "unit_guid", "msg_id", "text", "context", "class", "level", "area", "addr", "block",
+	"type", "bit", "invert_bit",
+}
+
+// NaturalKey are the message columns that identify a message of a unit across files
+type NaturalKey []string
+
+// UpsertResult counts what merging the messages of a file did
+type UpsertResult struct {
+	Inserted  int64 // messages with a new key
+	Updated   int64 // stored messages whose fields changed
+	Unchanged int64 // stored messages left as they are
+	Deleted   int64 // stored messages missing from the file, with deleteMissing
+	Repeated  int64 // stored messages deleted because a newer one had the same key
+}
+
+// NewNaturalKey checks the natural key columns: known message columns, each once, unit_guid among them
+func NewNaturalKey(columns []string) (NaturalKey, error) {
+	known := make(map[string]bool, len(messageDataColumns))
+	for _, col := range messageDataColumns {
+		known[col] = true
+	}
+
+	seen := make(map[string]bool, len(columns))
+	for _, col := range columns {
+		if !known[col] {
+			return nil, fmt.Errorf("unknown message column %q in natural key", col)
+		}
+		if seen[col] {
+			return nil, fmt.Errorf("column %q is repeated in natural key", col)
+		}
+		seen[col] = true
+	}
+	if !seen["unit_guid"] {
+		return nil, fmt.Errorf("natural key must include unit_guid")
+	}
+
+	return NaturalKey(columns), nil
+}
+
+// match is the condition that rows a and b have the same key
+func (k NaturalKey) match(a, b string) string {
+	conds := make([]string, 0, len(k))
+	for _, col := range k {
+		if col == "unit_guid" {
+			conds = append(conds, fmt.Sprintf("%[1]s.unit_guid = %[2]s.unit_guid", a, b)) // not null, lets the index be used
+			continue
+		}
+		conds = append(conds, fmt.Sprintf("%[1]s.%[3]s IS NOT DISTINCT FROM %[2]s.%[3]s", a, b, col))
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// has reports whether the column is part of the key
+func (k NaturalKey) has(column string) bool {
+	return slices.Contains(k, column)
+}
+
+// Dedupe drops the messages whose key is repeated later in the slice, as Upsert does with the staged rows,
+// so what is left are the messages a merged file stores
+func (k NaturalKey) Dedupe(msgs []*models.Message) ([]*models.Message, error) {
+	last := make(map[string]int, len(msgs))
+	keys := make([]string, len(msgs))
+	for i, msg := range msgs {
+		key, err := k.of(msg)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+		last[key] = i
+	}
+
+	kept := make([]*models.Message, 0, len(last))
+	for i, msg := range msgs {
+		if last[keys[i]] == i {
+			kept = append(kept, msg)
+		}
+	}
+	return kept, nil
+}
+
+// dedupeStaged deletes the rows of a staging table whose key is repeated on a later line of the file
+func dedupeStaged(ctx context.Context, db DBTX, table string, key NaturalKey) error {
+	if _, err := db.Exec(ctx, `
+		DELETE FROM `+table+` s
+		USING `+table+` l
+		WHERE `+key.match("l", "s")+` AND l.source_line > s.source_line
+	`); err != nil {
+		return fmt.Errorf("deduplicate staged messages failed: %w", err)
+	}
+	return nil
+}
+
+// lockUnits takes transaction-level advisory locks on the units of the staging table, in a fixed order,
+// so two files of a unit are merged one after the other
+func lockUnits(ctx context.Context, db DBTX, table string) error {
+	if _, err := db.Exec(ctx, `
+		SELECT pg_advisory_xact_lock(hashtextextended('unit:' || unit_guid::text, 0))
+		FROM (SELECT DISTINCT unit_guid FROM `+table+` ORDER BY unit_guid) u
+	`); err != nil {
+		return fmt.Errorf("lock units failed: %w", err)
+	}
+	return nil
+}
+
+// Staging creates the temporary table the messages of a file are written to before Upsert merges them,
+// and returns a repository whose Insert and InsertBatch write there.
+// It must be called inside a transaction, the table is dropped on commit or rollback.
+func (r *MessageRepo) Staging(ctx context.Context) (*MessageRepo, error) {
+	if _, err := r.db.Exec(ctx, `
+		CREATE TEMP TABLE `+messageStagingTable+` (LIKE "messages" INCLUDING DEFAULTS INCLUDING CONSTRAINTS)
+		ON COMMIT DROP
+	`); err != nil {
+		return nil, fmt.Errorf("create message staging table failed: %w", err)
+	}
+	return &MessageRepo{db: r.db, table: messageStagingTable}, nil
+}
+
+// Upsert merges the staged messages into the stored ones by the natural key. A staged message whose key
+// is new is inserted, a stored one with the key is updated when any of its fields changed and left as it is
+// otherwise; either way it is linked to the staged file and line, the last file that defined it.
+// Of several staged messages with the same key the one from the last line wins, of several stored ones,
+// appended before, the newest is kept and the rest are deleted.
+// With deleteMissing the stored messages of the staged units that have no staged message with their key are deleted.
+func (r *MessageRepo) Upsert(ctx context.Context, key NaturalKey, deleteMissing bool) (*UpsertResult, error) {
+	matchKey := key.match("m", "s")
+
+	// the rest of the fields decide whether a stored message changed
+	var fields, stored, staged []string
+	for _, col := range messageDataColumns {
+		if key.has(col) {
+			continue
+		}
+		fields = append(fields, fmt.Sprintf("%[1]s = s.%[1]s", col))
+		stored = append(stored, "m."+col)
+		staged = append(staged, "s."+col)
+	}
+
+	if err := lockUnits(ctx, r.db, messageStagingTable); err != nil {
+		return nil, err
+	}
+	if err := dedupeStaged(ctx, r.db, messageStagingTable, key); err != nil {
+		return nil, err
+	}
+
+	var total int64
+	if err := r.db.QueryRow(ctx, `SELECT COUNT(*) FROM `+messageStagingTable).Scan(&total); err != nil {
+		return nil, fmt.Errorf("count staged messages failed: %w", err)
+	}
+
+	var res UpsertResult
+	tag, err := r.db.Exec(ctx, `
+		DELETE FROM "messages" m
+		USING "messages" d, `+messageStagingTable+` s
+		WHERE `+matchKey+` AND `+key.match("d", "s")+` AND (d.created_at, d.id) > (m.created_at, m.id)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("delete repeated messages failed: %w", err)
+	}
+	res.Repeated = tag.RowsAffected()
+
+	tag, err = r.db.Exec(ctx, `
+		UPDATE "messages" m
+		SET `+strings.Join(fields, ", ")+`, source_file_id = s.source_file_id, source_line = s.source_line
+		FROM `+messageStagingTable+` s
+		WHERE `+matchKey+`
+		  AND (`+strings.Join(stored, ", ")+`) IS DISTINCT FROM (`+strings.Join(staged, ", ")+`)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("update changed messages failed: %w", err)
+	}
+	res.Updated = tag.RowsAffected()
+
+	// the unchanged ones too, so deleting the data of an older file keeps what this one defines
+	if _, err := r.db.Exec(ctx, `
+		UPDATE "messages" m
+		SET source_file_id = s.source_file_id, source_line = s.source_line
+		FROM `+messageStagingTable+` s
+		WHERE `+matchKey+`
+		  AND (m.source_file_id, m.source_line) IS DISTINCT FROM (s.source_file_id, s.source_line)
+	`); err != nil {
+		return nil, fmt.Errorf("update message sources failed: %w", err)
+	}
+
+	tag, err = r.db.Exec(ctx, `
+		INSERT INTO "messages" (`+strings.Join(messageCopyColumns, ", ")+`)
+		SELECT `+strings.Join(messageCopyColumns, ", ")+`
+		FROM `+messageStagingTable+` s
+		WHERE NOT EXISTS (SELECT 1 FROM "messages" m WHERE `+matchKey+`)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("insert new messages failed: %w", err)
+	}
+	res.Inserted = tag.RowsAffected()
+	res.Unchanged = max(total-res.Inserted-res.Updated, 0)
+
+	if deleteMissing {
+		tag, err = r.db.Exec(ctx, `
+			DELETE FROM "messages" m
+			WHERE m.unit_guid IN (SELECT DISTINCT unit_guid FROM `+messageStagingTable+`)
+			  AND NOT EXISTS (SELECT 1 FROM `+messageStagingTable+` s WHERE `+matchKey+`)
+		`)
+		if err != nil {
+			return nil, fmt.Errorf("delete missing messages failed: %w", err)
+		}
+		res.Deleted = tag.RowsAffected()
+	}
+
+	return &res, nil
+}
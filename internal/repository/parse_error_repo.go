@@ -5,18 +5,25 @@ import (
 	"context"
 	"fmt"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"strings"
 	"time"
 )
 
 type ParseErrorRepo struct {
-	db *pgxpool.Pool
+	db DBTX
 }
 
 func NewParseErrorRepo(db *pgxpool.Pool) *ParseErrorRepo {
 	return &ParseErrorRepo{db: db}
 }
 
+// WithTx returns a copy of the repository that runs its queries in tx
+func (r *ParseErrorRepo) WithTx(tx pgx.Tx) *ParseErrorRepo {
+	return &ParseErrorRepo{db: tx}
+}
+
 func (r *ParseErrorRepo) Insert(ctx context.Context, e *models.ParseError) error {
 	if e.ID == uuid.Nil {
 		e.ID = uuid.New()
@@ -26,31 +33,120 @@ func (r *ParseErrorRepo) Insert(ctx context.Context, e *models.ParseError) error
 	}
 
 	_, err := r.db.Exec(ctx, `
-		INSERT INTO "parse_errors" (id, filename, raw_line, error_text, created_at)
-		VALUES ($1,$2,$3,$4,$5)
+		INSERT INTO "parse_errors"
+		    (id, file_id, filename, line_number, byte_offset, column_name, error_code, raw_line, error_text, created_at)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)
 	`,
-		e.ID, e.Filename, e.RawLine, e.ErrorText, e.CreatedAt,
+		e.ID, e.FileID, e.Filename, e.LineNumber, e.ByteOffset, e.ColumnName, e.ErrorCode, e.RawLine, e.ErrorText,
+		e.CreatedAt,
 	)
-	return err
+	if err != nil {
+		return fmt.Errorf("insert parse_error failed: %w", err)
+	}
+	return nil
+}
+
+// parseErrorColumns is the select list read by scanParseErrors
+const parseErrorColumns = `
+	id, file_id, filename, COALESCE(line_number, 0), COALESCE(byte_offset, 0), COALESCE(column_name, ''),
+	COALESCE(error_code, ''), raw_line, error_text, created_at`
+
+// ParseErrorFilter narrows a parse error query, zero fields are not filtered on
+type ParseErrorFilter struct {
+	Filename    string
+	Code        string
+	CreatedFrom time.Time // inclusive
+	CreatedTo   time.Time // exclusive
+}
+
+// where builds the WHERE clause of the filter with positional parameters, empty when nothing is filtered
+func (f ParseErrorFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	if f.Filename != "" {
+		add("filename = $%d", f.Filename)
+	}
+	if f.Code != "" {
+		add("error_code = $%d", f.Code)
+	}
+	if !f.CreatedFrom.IsZero() {
+		add("created_at >= $%d", f.CreatedFrom)
+	}
+	if !f.CreatedTo.IsZero() {
+		add("created_at < $%d", f.CreatedTo)
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
 }
 
-// List returns parse errors with pagination
-func (r *ParseErrorRepo) List(ctx context.Context, limit, offset int) ([]models.ParseError, error) {
-	rows, err := r.db.Query(ctx, `
-		SELECT id, filename, raw_line, error_text, created_at
+// List returns the parse errors matching the filter with pagination,
+// in line order when filtered by file and newest first otherwise
+func (r *ParseErrorRepo) List(ctx context.Context, filter ParseErrorFilter, limit, offset int) ([]models.ParseError, error) {
+	where, args := filter.where()
+	args = append(args, limit, offset)
+
+	orderBy := "created_at DESC, id"
+	if filter.Filename != "" {
+		orderBy = "line_number, created_at, id"
+	}
+
+	rows, err := r.db.Query(ctx, fmt.Sprintf(`
+		SELECT `+parseErrorColumns+`
 		FROM "parse_errors"
-		ORDER BY created_at DESC
-		LIMIT $1 OFFSET $2
-	`, limit, offset)
+		%s
+		ORDER BY %s
+		LIMIT $%d OFFSET $%d
+	`, where, orderBy, len(args)-1, len(args)), args...)
 	if err != nil {
 		return nil, fmt.Errorf("list parse_errors failed: %w", err)
 	}
+	return scanParseErrors(rows)
+}
+
+// Count returns the number of parse errors matching the filter
+func (r *ParseErrorRepo) Count(ctx context.Context, filter ParseErrorFilter) (int, error) {
+	where, args := filter.where()
+
+	var count int
+	err := r.db.QueryRow(ctx, `
+		SELECT COUNT(*)
+		FROM "parse_errors"
+		`+where, args...).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("count parse_errors failed: %w", err)
+	}
+	return count, nil
+}
+
+// DeleteByFile deletes the parse errors of the file and returns how many there were.
+// Errors recorded before they were linked to files are kept: a name is shared by every content revision of a file,
+// so it can't tell which of them they belong to.
+func (r *ParseErrorRepo) DeleteByFile(ctx context.Context, fileID uuid.UUID) (int64, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM "parse_errors" WHERE file_id=$1`, fileID)
+	if err != nil {
+		return 0, fmt.Errorf("delete parse_errors of file failed: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func scanParseErrors(rows pgx.Rows) ([]models.ParseError, error) {
 	defer rows.Close()
 
 	var errs []models.ParseError
 	for rows.Next() {
 		var e models.ParseError
-		if err := rows.Scan(&e.ID, &e.Filename, &e.RawLine, &e.ErrorText, &e.CreatedAt); err != nil {
+		if err := rows.Scan(
+			&e.ID, &e.FileID, &e.Filename, &e.LineNumber, &e.ByteOffset, &e.ColumnName,
+			&e.ErrorCode, &e.RawLine, &e.ErrorText, &e.CreatedAt,
+		); err != nil {
 			return nil, fmt.Errorf("scan parse_error failed: %w", err)
 		}
 		errs = append(errs, e)
@@ -3,20 +3,27 @@ package repository
 import (
 	"biocad-tsv-service/internal/models"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"time"
 )
 
 type ProcessedFileRepo struct {
-	db *pgxpool.Pool
+	db DBTX
 }
 
 func NewProcessedFileRepo(db *pgxpool.Pool) *ProcessedFileRepo {
 	return &ProcessedFileRepo{db: db}
 }
 
+// WithTx returns a copy of the repository that runs its queries in tx
+func (r *ProcessedFileRepo) WithTx(tx pgx.Tx) *ProcessedFileRepo {
+	return &ProcessedFileRepo{db: tx}
+}
+
 func (r *ProcessedFileRepo) Insert(ctx context.Context, file *models.ProcessedFile) error {
 	if file.ID == uuid.Nil {
 		file.ID = uuid.New()
@@ -25,23 +32,53 @@ func (r *ProcessedFileRepo) Insert(ctx context.Context, file *models.ProcessedFi
 		file.ProcessedAt = time.Now()
 	}
 
-	_, err := r.db.Exec(ctx, `
-		INSERT INTO "processed_files" (id, filename, processed_at, status)
-		VALUES ($1,$2,$3,$4)
+	// files are identified by content: the same content seen again
+	// updates the existing row instead of violating the UNIQUE index;
+	// the ingest is finished, so the failures of earlier attempts are cleared
+	err := r.db.QueryRow(ctx, `
+		INSERT INTO "processed_files"
+		    (id, filename, content_hash, size, mtime, processed_at, status, row_count, message_count, error_count)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)
+		ON CONFLICT (content_hash) DO UPDATE
+		SET filename = EXCLUDED.filename, size = EXCLUDED.size, mtime = EXCLUDED.mtime,
+		    processed_at = EXCLUDED.processed_at, status = EXCLUDED.status,
+		    attempts = 0, next_attempt_at = NULL, last_error = NULL,
+		    row_count = EXCLUDED.row_count, message_count = EXCLUDED.message_count,
+		    error_count = EXCLUDED.error_count
+		RETURNING id
 	`,
-		file.ID, file.Filename, file.ProcessedAt, file.Status,
+		file.ID, file.Filename, file.ContentHash, file.Size, file.MTime, file.ProcessedAt, file.Status,
+		file.RowCount, file.MessageCount, file.ErrorCount,
+	).Scan(&file.ID)
+	if err != nil {
+		return fmt.Errorf("insert processed_file failed: %w", err)
+	}
+	return nil
+}
+
+// processedFileColumns is the select list read by scanProcessedFile
+const processedFileColumns = `
+	id, filename, COALESCE(content_hash, ''), COALESCE(size, 0), COALESCE(mtime, processed_at),
+	COALESCE(location, ''), processed_at, status, attempts, next_attempt_at, last_error,
+	row_count, message_count, error_count`
+
+func scanProcessedFile(row pgx.Row, f *models.ProcessedFile) error {
+	return row.Scan(
+		&f.ID, &f.Filename, &f.ContentHash, &f.Size, &f.MTime,
+		&f.Location, &f.ProcessedAt, &f.Status, &f.Attempts, &f.NextAttemptAt, &f.LastError,
+		&f.RowCount, &f.MessageCount, &f.ErrorCount,
 	)
-	return err
 }
 
-// List returns processed files with pagination
-func (r *ProcessedFileRepo) List(ctx context.Context, limit, offset int) ([]models.ProcessedFile, error) {
+// List returns processed files with pagination, newest first. An empty status lists files of every status.
+func (r *ProcessedFileRepo) List(ctx context.Context, status string, limit, offset int) ([]models.ProcessedFile, error) {
 	rows, err := r.db.Query(ctx, `
-		SELECT id, filename, processed_at, status
+		SELECT `+processedFileColumns+`
 		FROM "processed_files"
-		ORDER BY processed_at DESC
-		LIMIT $1 OFFSET $2
-	`, limit, offset)
+		WHERE $1 = '' OR status = $1
+		ORDER BY processed_at DESC, id
+		LIMIT $2 OFFSET $3
+	`, status, limit, offset)
 	if err != nil {
 		return nil, fmt.Errorf("list processed_files failed: %w", err)
 	}
@@ -50,7 +87,7 @@ func (r *ProcessedFileRepo) List(ctx context.Context, limit, offset int) ([]mode
 	var files []models.ProcessedFile
 	for rows.Next() {
 		var f models.ProcessedFile
-		if err := rows.Scan(&f.ID, &f.Filename, &f.ProcessedAt, &f.Status); err != nil {
+		if err := scanProcessedFile(rows, &f); err != nil {
 			return nil, fmt.Errorf("scan processed_file failed: %w", err)
 		}
 		files = append(files, f)
@@ -62,18 +99,229 @@ func (r *ProcessedFileRepo) List(ctx context.Context, limit, offset int) ([]mode
 	return files, nil
 }
 
-// IsProcessed checks if a file with the given filename has already been processed successfully
-func (r *ProcessedFileRepo) IsProcessed(ctx context.Context, filename string) (bool, error) {
-	var exists bool
+// Count returns the number of processed files with the status, or of all files if status is empty
+func (r *ProcessedFileRepo) Count(ctx context.Context, status string) (int, error) {
+	var count int
+	err := r.db.QueryRow(ctx, `
+		SELECT COUNT(*)
+		FROM "processed_files"
+		WHERE $1 = '' OR status = $1
+	`, status).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("count processed_files failed: %w", err)
+	}
+	return count, nil
+}
+
+// GetByID returns the file with the given id or nil if there is none
+func (r *ProcessedFileRepo) GetByID(ctx context.Context, id uuid.UUID) (*models.ProcessedFile, error) {
+	var f models.ProcessedFile
+	err := scanProcessedFile(r.db.QueryRow(ctx, `
+		SELECT `+processedFileColumns+`
+		FROM "processed_files"
+		WHERE id=$1
+	`, id), &f)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get processed_file failed: %w", err)
+	}
+	return &f, nil
+}
+
+// GetByHash returns the file with the given content or nil if it was never seen
+func (r *ProcessedFileRepo) GetByHash(ctx context.Context, contentHash string) (*models.ProcessedFile, error) {
+	var f models.ProcessedFile
+	err := scanProcessedFile(r.db.QueryRow(ctx, `
+		SELECT `+processedFileColumns+`
+		FROM "processed_files"
+		WHERE content_hash=$1
+	`, contentHash), &f)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get processed_file failed: %w", err)
+	}
+	return &f, nil
+}
+
+// UpdateLocation records where the file was moved after processing
+func (r *ProcessedFileRepo) UpdateLocation(ctx context.Context, id uuid.UUID, location string) error {
+	if _, err := r.db.Exec(ctx, `
+		UPDATE "processed_files" SET location=$2 WHERE id=$1
+	`, id, location); err != nil {
+		return fmt.Errorf("update processed_file location failed: %w", err)
+	}
+	return nil
+}
+
+// Reset clears the ingest result of the file, its attempts and counters, and sets the status.
+// It is used when the file's data was deleted, with queued to ingest it again or purged to leave it out.
+func (r *ProcessedFileRepo) Reset(ctx context.Context, id uuid.UUID, status string) error {
+	if _, err := r.db.Exec(ctx, `
+		UPDATE "processed_files"
+		SET status=$2, attempts=0, next_attempt_at=NULL, last_error=NULL,
+		    row_count=0, message_count=0, error_count=0, processed_at=now()
+		WHERE id=$1
+	`, id, status); err != nil {
+		return fmt.Errorf("reset processed_file failed: %w", err)
+	}
+	return nil
+}
+
+// IsDue checks if the content should be processed now: it was never seen, it is waiting
+// or being parsed, or it failed before and its next retry is due. Processed, dead and purged files are not due.
+// Queueing a file that is being parsed is harmless, the queues drop duplicates and the parser
+// waits for the lock on the content.
+func (r *ProcessedFileRepo) IsDue(ctx context.Context, contentHash string) (bool, error) {
+	var due bool
 	err := r.db.QueryRow(ctx, `
-        SELECT EXISTS(
-            SELECT 1 
-            FROM processed_files 
-            WHERE filename=$1 AND status='success'
+        SELECT NOT EXISTS(
+            SELECT 1
+            FROM processed_files
+            WHERE content_hash=$1
+              AND (status IN ($2, $3, $4, $5) OR (status = $6 AND next_attempt_at > now()))
         )
-    `, filename).Scan(&exists)
+    `, contentHash, models.FileStatusSuccess, models.FileStatusFailed, models.FileStatusDead,
+		models.FileStatusPurged, models.FileStatusRetry).Scan(&due)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if file is due: %w", err)
+	}
+	return due, nil
+}
+
+// InsertQueued records a file that is waiting for ingest and returns its row.
+// If the content is known already, the existing row is returned unchanged.
+func (r *ProcessedFileRepo) InsertQueued(ctx context.Context, file *models.ProcessedFile) (*models.ProcessedFile, error) {
+	if file.ID == uuid.Nil {
+		file.ID = uuid.New()
+	}
+
+	// the no-op update makes RETURNING yield the existing row on conflict
+	var f models.ProcessedFile
+	err := scanProcessedFile(r.db.QueryRow(ctx, `
+		INSERT INTO "processed_files" (id, filename, content_hash, size, mtime, processed_at, status)
+		VALUES ($1,$2,$3,$4,$5,now(),$6)
+		ON CONFLICT (content_hash) DO UPDATE SET content_hash = processed_files.content_hash
+		RETURNING `+processedFileColumns+`
+	`,
+		file.ID, file.Filename, file.ContentHash, file.Size, file.MTime, models.FileStatusQueued,
+	), &f)
+	if err != nil {
+		return nil, fmt.Errorf("insert queued processed_file failed: %w", err)
+	}
+	return &f, nil
+}
+
+// MarkParsing records that a worker started ingesting the content.
+// Files that are processed already or dead keep their status.
+func (r *ProcessedFileRepo) MarkParsing(ctx context.Context, file *models.ProcessedFile) error {
+	if file.ID == uuid.Nil {
+		file.ID = uuid.New()
+	}
+
+	_, err := r.db.Exec(ctx, `
+		INSERT INTO "processed_files" (id, filename, content_hash, size, mtime, processed_at, status)
+		VALUES ($1,$2,$3,$4,$5,now(),$6)
+		ON CONFLICT (content_hash) DO UPDATE
+		SET filename = EXCLUDED.filename, status = EXCLUDED.status
+		WHERE processed_files.status IN ($7, $8, $6)
+	`,
+		file.ID, file.Filename, file.ContentHash, file.Size, file.MTime, models.FileStatusParsing,
+		models.FileStatusQueued, models.FileStatusRetry,
+	)
+	if err != nil {
+		return fmt.Errorf("mark processed_file as parsing failed: %w", err)
+	}
+	return nil
+}
+
+// RecordFailure counts a failed ingest attempt of the content. The file is retried after
+// backoff doubled for every earlier attempt, capped at maxBackoff, and is marked dead
+// once maxAttempts attempts have failed. The updated row is returned.
+// Only waiting content counts failures: a processed, dead or purged file is returned unchanged,
+// so a failed copy of it doesn't bring it back for another ingest.
+func (r *ProcessedFileRepo) RecordFailure(
+	ctx context.Context,
+	file *models.ProcessedFile,
+	cause error,
+	maxAttempts int,
+	backoff, maxBackoff time.Duration,
+) (*models.ProcessedFile, error) {
+	if file.ID == uuid.Nil {
+		file.ID = uuid.New()
+	}
+
+	var f models.ProcessedFile
+	err := scanProcessedFile(r.db.QueryRow(ctx, `
+		INSERT INTO "processed_files"
+		    (id, filename, content_hash, size, mtime, processed_at, status, attempts, next_attempt_at, last_error)
+		VALUES ($1,$2,$3,$4,$5,now(),
+		        CASE WHEN $7 <= 1 THEN $9 ELSE $8 END, 1, now() + make_interval(secs => $10), $6)
+		ON CONFLICT (content_hash) DO UPDATE
+		SET filename = EXCLUDED.filename, size = EXCLUDED.size, mtime = EXCLUDED.mtime,
+		    processed_at = now(), last_error = EXCLUDED.last_error,
+		    attempts = processed_files.attempts + 1,
+		    status = CASE WHEN processed_files.attempts + 1 >= $7 THEN $9 ELSE $8 END,
+		    next_attempt_at = now() + make_interval(secs => LEAST($10 * power(2, processed_files.attempts), $11))
+		WHERE processed_files.status IN ($12, $13, $8)
+		RETURNING `+processedFileColumns+`
+	`,
+		file.ID, file.Filename, file.ContentHash, file.Size, file.MTime, cause.Error(),
+		maxAttempts, models.FileStatusRetry, models.FileStatusDead, backoff.Seconds(), maxBackoff.Seconds(),
+		models.FileStatusQueued, models.FileStatusParsing,
+	), &f)
+	if errors.Is(err, pgx.ErrNoRows) {
+		existing, err := r.GetByHash(ctx, file.ContentHash)
+		if err == nil && existing == nil {
+			err = errors.New("processed_file disappeared")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("record processed_file failure failed: %w", err)
+		}
+		return existing, nil
+	}
 	if err != nil {
-		return false, fmt.Errorf("failed to check if file is processed: %w", err)
+		return nil, fmt.Errorf("record processed_file failure failed: %w", err)
+	}
+	return &f, nil
+}
+
+// Requeue gives a dead file a fresh set of attempts, the scanner picks it up on its next pass.
+// It reports false if there is no dead file with the id.
+func (r *ProcessedFileRepo) Requeue(ctx context.Context, id uuid.UUID) (bool, error) {
+	tag, err := r.db.Exec(ctx, `
+		UPDATE "processed_files"
+		SET status=$3, attempts=0, next_attempt_at=now()
+		WHERE id=$1 AND status=$2
+	`, id, models.FileStatusDead, models.FileStatusRetry)
+	if err != nil {
+		return false, fmt.Errorf("requeue processed_file failed: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// RequeueDead requeues every dead file and returns how many there were
+func (r *ProcessedFileRepo) RequeueDead(ctx context.Context) (int64, error) {
+	tag, err := r.db.Exec(ctx, `
+		UPDATE "processed_files"
+		SET status=$2, attempts=0, next_attempt_at=now()
+		WHERE status=$1
+	`, models.FileStatusDead, models.FileStatusRetry)
+	if err != nil {
+		return 0, fmt.Errorf("requeue dead processed_files failed: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// LockContent takes a transaction-level advisory lock on the content hash,
+// so two workers can't ingest the same content at the same time.
+// It must be called inside a transaction, the lock is released on commit or rollback.
+func (r *ProcessedFileRepo) LockContent(ctx context.Context, contentHash string) error {
+	if _, err := r.db.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtextextended($1, 0))`, contentHash); err != nil {
+		return fmt.Errorf("failed to lock content %s: %w", contentHash, err)
 	}
-	return exists, nil
+	return nil
 }
@@ -0,0 +1,352 @@
+package repository
+
+import (
+	"biocad-tsv-service/internal/models"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// versionStagingTable holds the message versions of the file being ingested
+const versionStagingTable = "version_staging"
+
+// versionCopyColumns is the column order used to stage message versions
+var versionCopyColumns = append(slices.Clone(messageCopyColumns), "valid_from", "from_revision")
+
+type RevisionRepo struct {
+	db DBTX
+}
+
+func NewRevisionRepo(db *pgxpool.Pool) *RevisionRepo {
+	return &RevisionRepo{db: db}
+}
+
+// WithTx returns a copy of the repository that runs its queries in tx
+func (r *RevisionRepo) WithTx(tx pgx.Tx) *RevisionRepo {
+	return &RevisionRepo{db: tx}
+}
+
+// Record adds a revision for every unit of the messages of a file and updates the message versions:
+// the current versions the file doesn't contain unchanged are closed, and the messages that are new or changed
+// open new versions. Messages are matched by the natural key, of several with the same key the last line wins.
+// It must be called inside a transaction, the units are locked until its end.
+func (r *RevisionRepo) Record(
+	ctx context.Context,
+	fileID uuid.UUID,
+	msgs []*models.Message,
+	key NaturalKey,
+) ([]models.UnitRevision, error) {
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+
+	seen := make(map[uuid.UUID]struct{})
+	for _, msg := range msgs {
+		seen[msg.UnitGUID] = struct{}{}
+	}
+	units := slices.Collect(maps.Keys(seen))
+	// the same order as the locks taken by an upsert, so the two never deadlock
+	slices.SortFunc(units, func(a, b uuid.UUID) int { return bytes.Compare(a[:], b[:]) })
+
+	now := time.Now().Truncate(time.Microsecond)
+	revisions := make([]models.UnitRevision, 0, len(units))
+	numbers := make(map[uuid.UUID]int, len(units))
+	for _, unit := range units {
+		if _, err := r.db.Exec(ctx,
+			`SELECT pg_advisory_xact_lock(hashtextextended('unit:' || $1::text, 0))`, unit); err != nil {
+			return nil, fmt.Errorf("failed to lock unit %s: %w", unit, err)
+		}
+
+		rev := models.UnitRevision{ID: uuid.New(), UnitGUID: unit, FileID: &fileID, CreatedAt: now}
+		err := r.db.QueryRow(ctx, `
+			INSERT INTO "unit_revisions" (id, unit_guid, revision, file_id, created_at)
+			SELECT $1, $2, COALESCE(MAX(revision), 0) + 1, $3, $4
+			FROM "unit_revisions"
+			WHERE unit_guid=$2
+			RETURNING revision
+		`, rev.ID, unit, fileID, now).Scan(&rev.Revision)
+		if err != nil {
+			return nil, fmt.Errorf("insert unit_revision failed: %w", err)
+		}
+		numbers[unit] = rev.Revision
+		revisions = append(revisions, rev)
+	}
+
+	if _, err := r.db.Exec(ctx, `
+		CREATE TEMP TABLE `+versionStagingTable+` (LIKE "message_versions" INCLUDING DEFAULTS)
+		ON COMMIT DROP
+	`); err != nil {
+		return nil, fmt.Errorf("create version staging table failed: %w", err)
+	}
+	rows := make([][]any, 0, len(msgs))
+	for _, msg := range msgs {
+		rows = append(rows, []any{
+			uuid.New(), msg.MQTT, msg.UnitGUID, msg.MsgId, msg.Text, msg.Context, msg.Class,
+			msg.Level, msg.Area, msg.Addr, msg.Block, msg.Type, msg.Bit, msg.InvertBit, msg.CreatedAt,
+			msg.SourceFileID, msg.SourceLine, now, numbers[msg.UnitGUID],
+		})
+	}
+	if _, err := r.db.CopyFrom(ctx, pgx.Identifier{versionStagingTable}, versionCopyColumns, pgx.CopyFromRows(rows)); err != nil {
+		return nil, fmt.Errorf("copy message versions failed: %w", err)
+	}
+	if err := dedupeStaged(ctx, r.db, versionStagingTable, key); err != nil {
+		return nil, err
+	}
+
+	// a version is the same while all fields read from the file are
+	current := make([]string, 0, len(messageDataColumns))
+	staged := make([]string, 0, len(messageDataColumns))
+	for _, col := range messageDataColumns {
+		current = append(current, "v."+col)
+		staged = append(staged, "s."+col)
+	}
+	same := "(" + strings.Join(current, ", ") + ") IS NOT DISTINCT FROM (" + strings.Join(staged, ", ") + ")"
+
+	if _, err := r.db.Exec(ctx, `
+		UPDATE "message_versions" v
+		SET valid_to = n.valid_from, to_revision = n.from_revision
+		FROM (SELECT DISTINCT unit_guid, valid_from, from_revision FROM `+versionStagingTable+`) n
+		WHERE v.unit_guid = n.unit_guid AND v.valid_to IS NULL
+		  AND NOT EXISTS (SELECT 1 FROM `+versionStagingTable+` s WHERE s.unit_guid = v.unit_guid AND `+same+`)
+	`); err != nil {
+		return nil, fmt.Errorf("close message versions failed: %w", err)
+	}
+
+	if _, err := r.db.Exec(ctx, `
+		INSERT INTO "message_versions" (`+strings.Join(versionCopyColumns, ", ")+`)
+		SELECT `+strings.Join(versionCopyColumns, ", ")+`
+		FROM `+versionStagingTable+` s
+		WHERE NOT EXISTS (
+			SELECT 1 FROM "message_versions" v
+			WHERE v.unit_guid = s.unit_guid AND v.valid_to IS NULL AND `+same+`
+		)
+	`); err != nil {
+		return nil, fmt.Errorf("insert message versions failed: %w", err)
+	}
+
+	counts, err := r.db.Query(ctx, `
+		UPDATE "unit_revisions" r
+		SET message_count = n.message_count
+		FROM (SELECT unit_guid, from_revision, COUNT(*) AS message_count FROM `+versionStagingTable+` GROUP BY 1, 2) n
+		WHERE r.unit_guid = n.unit_guid AND r.revision = n.from_revision
+		RETURNING r.unit_guid, r.message_count
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("count revision messages failed: %w", err)
+	}
+	defer counts.Close()
+	for counts.Next() {
+		var unit uuid.UUID
+		var count int
+		if err := counts.Scan(&unit, &count); err != nil {
+			return nil, fmt.Errorf("scan revision count failed: %w", err)
+		}
+		for i := range revisions {
+			if revisions[i].UnitGUID == unit {
+				revisions[i].MessageCount = count
+			}
+		}
+	}
+	if err := counts.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return revisions, nil
+}
+
+// DeleteByFile removes the revisions made by ingests of the file, as if it had never been ingested, and returns
+// their units. The interval of a removed revision joins the next revision of the unit: versions only the removed
+// one had are deleted, versions the next one still has start at it, and versions the removed one closed are
+// closed by the next one, or are current again if there is none.
+// It must be called inside a transaction, the units are locked until its end.
+func (r *RevisionRepo) DeleteByFile(ctx context.Context, fileID uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+unitRevisionColumns+`
+		FROM "unit_revisions"
+		WHERE file_id=$1
+		ORDER BY unit_guid, revision DESC
+	`, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("query unit_revisions of file failed: %w", err)
+	}
+	var revisions []models.UnitRevision
+	for rows.Next() {
+		var rev models.UnitRevision
+		if err := scanUnitRevision(rows, &rev); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan unit_revision failed: %w", err)
+		}
+		revisions = append(revisions, rev)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+	// ordered by unit like the locks taken by Record, so the two never deadlock
+	slices.SortStableFunc(revisions, func(a, b models.UnitRevision) int {
+		return bytes.Compare(a.UnitGUID[:], b.UnitGUID[:])
+	})
+
+	var units []uuid.UUID
+	for _, rev := range revisions {
+		if len(units) == 0 || units[len(units)-1] != rev.UnitGUID {
+			if _, err := r.db.Exec(ctx,
+				`SELECT pg_advisory_xact_lock(hashtextextended('unit:' || $1::text, 0))`, rev.UnitGUID); err != nil {
+				return nil, fmt.Errorf("failed to lock unit %s: %w", rev.UnitGUID, err)
+			}
+			units = append(units, rev.UnitGUID)
+		}
+
+		// no next revision leaves both NULL: the versions of the removed one are all current and go,
+		// and the versions it closed are current again
+		var next *int
+		var nextAt *time.Time
+		err := r.db.QueryRow(ctx, `
+			SELECT revision, created_at FROM "unit_revisions"
+			WHERE unit_guid=$1 AND revision > $2
+			ORDER BY revision
+			LIMIT 1
+		`, rev.UnitGUID, rev.Revision).Scan(&next, &nextAt)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("get next unit_revision failed: %w", err)
+		}
+
+		if _, err := r.db.Exec(ctx, `
+			DELETE FROM "message_versions"
+			WHERE unit_guid=$1 AND from_revision=$2 AND to_revision IS NOT DISTINCT FROM $3
+		`, rev.UnitGUID, rev.Revision, next); err != nil {
+			return nil, fmt.Errorf("delete message_versions failed: %w", err)
+		}
+		if next != nil {
+			if _, err := r.db.Exec(ctx, `
+				UPDATE "message_versions" SET from_revision=$3, valid_from=$4
+				WHERE unit_guid=$1 AND from_revision=$2
+			`, rev.UnitGUID, rev.Revision, *next, *nextAt); err != nil {
+				return nil, fmt.Errorf("move message_versions failed: %w", err)
+			}
+		}
+		if _, err := r.db.Exec(ctx, `
+			UPDATE "message_versions" SET to_revision=$3, valid_to=$4
+			WHERE unit_guid=$1 AND to_revision=$2
+		`, rev.UnitGUID, rev.Revision, next, nextAt); err != nil {
+			return nil, fmt.Errorf("reopen message_versions failed: %w", err)
+		}
+		if _, err := r.db.Exec(ctx, `DELETE FROM "unit_revisions" WHERE id=$1`, rev.ID); err != nil {
+			return nil, fmt.Errorf("delete unit_revision failed: %w", err)
+		}
+	}
+	return units, nil
+}
+
+// unitRevisionColumns is the select list read by scanUnitRevision
+const unitRevisionColumns = `id, unit_guid, revision, file_id, message_count, created_at`
+
+// List returns the revisions of a unit with pagination, newest first
+func (r *RevisionRepo) List(ctx context.Context, unitGUID uuid.UUID, limit, offset int) ([]models.UnitRevision, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+unitRevisionColumns+`
+		FROM "unit_revisions"
+		WHERE unit_guid=$1
+		ORDER BY revision DESC
+		LIMIT $2 OFFSET $3
+	`, unitGUID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("list unit_revisions failed: %w", err)
+	}
+	defer rows.Close()
+
+	var revisions []models.UnitRevision
+	for rows.Next() {
+		var rev models.UnitRevision
+		if err := scanUnitRevision(rows, &rev); err != nil {
+			return nil, fmt.Errorf("scan unit_revision failed: %w", err)
+		}
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+	return revisions, nil
+}
+
+// Count returns the number of revisions of a unit
+func (r *RevisionRepo) Count(ctx context.Context, unitGUID uuid.UUID) (int, error) {
+	var count int
+	if err := r.db.QueryRow(ctx, `SELECT COUNT(*) FROM "unit_revisions" WHERE unit_guid=$1`, unitGUID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("count unit_revisions failed: %w", err)
+	}
+	return count, nil
+}
+
+// Get returns a revision of a unit, nil if there is no such revision
+func (r *RevisionRepo) Get(ctx context.Context, unitGUID uuid.UUID, revision int) (*models.UnitRevision, error) {
+	return r.getOne(ctx, `WHERE unit_guid=$1 AND revision=$2`, unitGUID, revision)
+}
+
+// Latest returns the newest revision of a unit, nil if the unit was never ingested
+func (r *RevisionRepo) Latest(ctx context.Context, unitGUID uuid.UUID) (*models.UnitRevision, error) {
+	return r.getOne(ctx, `WHERE unit_guid=$1 ORDER BY revision DESC LIMIT 1`, unitGUID)
+}
+
+// AsOf returns the revision of a unit that was current at the time, nil if the unit wasn't ingested yet
+func (r *RevisionRepo) AsOf(ctx context.Context, unitGUID uuid.UUID, at time.Time) (*models.UnitRevision, error) {
+	return r.getOne(ctx, `WHERE unit_guid=$1 AND created_at <= $2 ORDER BY revision DESC LIMIT 1`, unitGUID, at)
+}
+
+// getOne reads the revision selected by the rest of the query, nil if there is none
+func (r *RevisionRepo) getOne(ctx context.Context, query string, args ...any) (*models.UnitRevision, error) {
+	var rev models.UnitRevision
+	err := scanUnitRevision(r.db.QueryRow(ctx, `SELECT `+unitRevisionColumns+` FROM "unit_revisions" `+query, args...), &rev)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get unit_revision failed: %w", err)
+	}
+	return &rev, nil
+}
+
+// Versions returns the message versions that made up the unit's definition at the revision
+func (r *RevisionRepo) Versions(ctx context.Context, unitGUID uuid.UUID, revision int) ([]models.MessageVersion, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+messageColumns+`, valid_from, valid_to, from_revision, to_revision
+		FROM "message_versions"
+		WHERE unit_guid=$1 AND from_revision <= $2 AND (to_revision IS NULL OR to_revision > $2)
+		ORDER BY msg_id, source_line, id
+	`, unitGUID, revision)
+	if err != nil {
+		return nil, fmt.Errorf("query message_versions failed: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []models.MessageVersion
+	for rows.Next() {
+		var v models.MessageVersion
+		if err := rows.Scan(
+			&v.ID, &v.MQTT, &v.UnitGUID, &v.MsgId, &v.Text,
+			&v.Context, &v.Class, &v.Level,
+			&v.Area, &v.Addr, &v.Block, &v.Type,
+			&v.Bit, &v.InvertBit, &v.CreatedAt, &v.SourceFileID, &v.SourceLine,
+			&v.ValidFrom, &v.ValidTo, &v.FromRevision, &v.ToRevision,
+		); err != nil {
+			return nil, fmt.Errorf("scan message_version failed: %w", err)
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+	return versions, nil
+}
+
+func scanUnitRevision(row pgx.Row, rev *models.UnitRevision) error {
+	return row.Scan(&rev.ID, &rev.UnitGUID, &rev.Revision, &rev.FileID, &rev.MessageCount, &rev.CreatedAt)
+}
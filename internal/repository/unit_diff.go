@@ -0,0 +1,143 @@
+package repository
+
+import (
+	"biocad-tsv-service/internal/models"
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"reflect"
+	"strings"
+)
+
+// messageFieldIndex maps a message column to the index of its field in models.Message, by the db tags
+var messageFieldIndex = func() map[string]int {
+	t := reflect.TypeOf(models.Message{})
+	index := make(map[string]int, t.NumField())
+	for i := range t.NumField() {
+		if column := t.Field(i).Tag.Get("db"); column != "" {
+			index[column] = i
+		}
+	}
+	return index
+}()
+
+// messageField returns the value of a message column, nil for an empty optional one
+func messageField(m *models.Message, column string) (any, error) {
+	i, ok := messageFieldIndex[column]
+	if !ok {
+		return nil, fmt.Errorf("unknown message column %q", column)
+	}
+	v := reflect.ValueOf(m).Elem().Field(i)
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	return v.Interface(), nil
+}
+
+// of returns the key of a message as a string, equal for messages with the same key
+func (k NaturalKey) of(m *models.Message) (string, error) {
+	var b strings.Builder
+	for _, col := range k {
+		v, err := messageField(m, col)
+		if err != nil {
+			return "", err
+		}
+		if v != nil {
+			fmt.Fprintf(&b, "=%v", v)
+		} else {
+			b.WriteByte('!')
+		}
+		b.WriteByte(0)
+	}
+	return b.String(), nil
+}
+
+// Diff compares the definitions of a unit at two revisions, matching the messages by the natural key.
+// A nil from compares with the unit before its first ingest.
+func (r *RevisionRepo) Diff(
+	ctx context.Context,
+	unitGUID uuid.UUID,
+	from, to *models.UnitRevision,
+	key NaturalKey,
+) (*models.UnitDiff, error) {
+	var before []models.MessageVersion
+	if from != nil {
+		var err error
+		if before, err = r.Versions(ctx, unitGUID, from.Revision); err != nil {
+			return nil, err
+		}
+	}
+	after, err := r.Versions(ctx, unitGUID, to.Revision)
+	if err != nil {
+		return nil, err
+	}
+
+	// several versions with one key, possible if the key was changed in between, are paired in order
+	byKey := make(map[string][]models.MessageVersion, len(before))
+	for _, v := range before {
+		k, err := key.of(&v.Message)
+		if err != nil {
+			return nil, err
+		}
+		byKey[k] = append(byKey[k], v)
+	}
+
+	diff := &models.UnitDiff{UnitGUID: unitGUID, From: from, To: to}
+	matched := make(map[uuid.UUID]bool, len(before))
+	for _, v := range after {
+		k, err := key.of(&v.Message)
+		if err != nil {
+			return nil, err
+		}
+		if len(byKey[k]) == 0 {
+			diff.Added = append(diff.Added, v)
+			continue
+		}
+		old := byKey[k][0]
+		byKey[k] = byKey[k][1:]
+		matched[old.ID] = true
+
+		// a version is shared by every revision it was valid in
+		if old.ID == v.ID {
+			continue
+		}
+		changes, err := fieldChanges(&old.Message, &v.Message, key)
+		if err != nil {
+			return nil, err
+		}
+		if len(changes) > 0 {
+			diff.Modified = append(diff.Modified, models.MessageChange{From: old, To: v, Changes: changes})
+		}
+	}
+	for _, v := range before {
+		if !matched[v.ID] {
+			diff.Removed = append(diff.Removed, v)
+		}
+	}
+	return diff, nil
+}
+
+// fieldChanges lists the fields read from the file that differ between two messages with the same key
+func fieldChanges(from, to *models.Message, key NaturalKey) ([]models.FieldChange, error) {
+	var changes []models.FieldChange
+	for _, col := range messageDataColumns {
+		if key.has(col) {
+			continue
+		}
+		a, err := messageField(from, col)
+		if err != nil {
+			return nil, err
+		}
+		b, err := messageField(to, col)
+		if err != nil {
+			return nil, err
+		}
+		if a != b {
+			changes = append(changes, models.FieldChange{Field: col, From: a, To: b})
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,76 @@
+package worker
+
+import (
+	"biocad-tsv-service/internal/queue"
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Pool runs a set of workers whose size can be changed while the service is running
+type Pool struct {
+	ctx       context.Context
+	queue     queue.Queue
+	processor *Processor
+	heartbeat time.Duration
+
+	mu      sync.Mutex
+	workers []context.CancelFunc // stops the running workers, in start order
+	nextID  int
+	wg      sync.WaitGroup
+}
+
+// NewPool creates a Pool without workers, they run until ctx is done
+func NewPool(ctx context.Context, q queue.Queue, p *Processor, heartbeat time.Duration) *Pool {
+	return &Pool{
+		ctx:       ctx,
+		queue:     q,
+		processor: p,
+		heartbeat: heartbeat,
+	}
+}
+
+// Resize starts or stops workers until n are running.
+// Stopped workers finish the file they are processing first.
+func (p *Pool) Resize(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if n == len(p.workers) {
+		return
+	}
+	log.Printf("[workers] resizing pool from %d to %d", len(p.workers), n)
+
+	for len(p.workers) < n {
+		stop, cancel := context.WithCancel(p.ctx)
+		id := p.nextID
+		p.nextID++
+		p.workers = append(p.workers, cancel)
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			Run(p.ctx, stop, id, p.queue, p.processor, p.heartbeat)
+		}()
+	}
+
+	// the newest workers are stopped first
+	for len(p.workers) > n {
+		last := len(p.workers) - 1
+		p.workers[last]()
+		p.workers = p.workers[:last]
+	}
+}
+
+// Size returns the number of running workers
+func (p *Pool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.workers)
+}
+
+// Wait blocks until all workers have exited, including the ones stopped by Resize
+func (p *Pool) Wait() {
+	p.wg.Wait()
+}
@@ -0,0 +1,237 @@
+package worker
+
+import (
+	"biocad-tsv-service/internal/models"
+	"biocad-tsv-service/internal/pdf"
+	"biocad-tsv-service/internal/queue"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"log"
+	"os"
+	"slices"
+)
+
+var (
+	// ErrFileNotFound is returned when there is no processed file with the id
+	ErrFileNotFound = errors.New("file not found")
+	// ErrFileBusy is returned for a file that is waiting for a worker or being parsed
+	ErrFileBusy = errors.New("file is queued or being parsed")
+	// ErrSourceMissing is returned when the file to reprocess is no longer on disk
+	ErrSourceMissing = errors.New("source file is missing")
+)
+
+// Reprocess deletes the messages, parse errors and revisions of the file, marks it as queued and, once that
+// is committed, puts the file back into the input directory, so the scanner hands it to a worker again. If the
+// file can't be put back its data stays deleted and it is marked as purged, to be reprocessed again later.
+// The PDF reports of its units are regenerated from what is left, and once more by the worker after the new ingest.
+func (p *Processor) Reprocess(ctx context.Context, id uuid.UUID) (*models.ProcessedFile, error) {
+	file, units, err := p.deleteData(ctx, id, models.FileStatusQueued, sourceExists)
+	if err != nil {
+		return nil, err
+	}
+	defer p.refreshReports(ctx, units)
+
+	if err := p.restore(ctx, file); err != nil {
+		if err := p.PFRepo.Reset(ctx, file.ID, models.FileStatusPurged); err != nil {
+			log.Printf("[reprocess] failed to mark file %s as purged: %v", file.ID, err)
+		}
+		return nil, err
+	}
+
+	log.Printf("[reprocess] file %s queued again from %s", file.ID, file.Location)
+	return file, nil
+}
+
+// Purge deletes the messages, parse errors and revisions of the file and marks it as purged, so the same content
+// is not ingested again until it is reprocessed. The file itself stays where it is.
+func (p *Processor) Purge(ctx context.Context, id uuid.UUID) (*models.ProcessedFile, error) {
+	file, units, err := p.deleteData(ctx, id, models.FileStatusPurged, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[purge] data of file %s deleted", file.ID)
+	p.refreshReports(ctx, units)
+	return file, nil
+}
+
+// Requeue gives a dead file a fresh set of attempts. The file is put back into the input directory first,
+// dead files are moved to the failed directory, and the scanner picks it up on its next pass.
+// It reports false if there is no dead file with the id.
+func (p *Processor) Requeue(ctx context.Context, id uuid.UUID) (bool, error) {
+	file, err := p.PFRepo.GetByID(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	if file == nil || file.Status != models.FileStatusDead {
+		return false, nil
+	}
+	if err := sourceExists(file); err != nil {
+		return false, err
+	}
+	// a dead file is not due, the scanner leaves it in the input directory until the row is requeued
+	if err := p.restore(ctx, file); err != nil {
+		return false, err
+	}
+	return p.PFRepo.Requeue(ctx, id)
+}
+
+// RequeueDead requeues every dead file and returns how many there were.
+// A file that can't be put back is logged and stays dead.
+func (p *Processor) RequeueDead(ctx context.Context) (int64, error) {
+	const pageSize = 100
+	var dead []models.ProcessedFile
+	for {
+		page, err := p.PFRepo.List(ctx, models.FileStatusDead, pageSize, len(dead))
+		if err != nil {
+			return 0, err
+		}
+		dead = append(dead, page...)
+		if len(page) < pageSize {
+			break
+		}
+	}
+
+	var n int64
+	for _, f := range dead {
+		requeued, err := p.Requeue(ctx, f.ID)
+		if err != nil {
+			log.Printf("[requeue] failed to requeue file %s: %v", f.ID, err)
+			continue
+		}
+		if requeued {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// sourcePath is where the file is now: its location after processing, or where it was read from
+func sourcePath(f *models.ProcessedFile) string {
+	if f.Location != "" {
+		return f.Location
+	}
+	return f.Filename
+}
+
+// sourceExists checks that the file can be put back into the input directory, before its data is deleted
+func sourceExists(f *models.ProcessedFile) error {
+	source := sourcePath(f)
+	if _, err := os.Stat(source); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrSourceMissing, source)
+		}
+		return fmt.Errorf("failed to stat %s: %w", source, err)
+	}
+	return nil
+}
+
+// restore moves the file back into the input directory with a done marker and records its new location,
+// also when the marker can't be written, since the file has moved anyway. A location that can't be recorded
+// is only logged: the file is queued, and the worker records where it ends up after the ingest.
+func (p *Processor) restore(ctx context.Context, f *models.ProcessedFile) error {
+	restored, err := p.Archiver.Restore(sourcePath(f), p.InputDir)
+	if err != nil {
+		return err
+	}
+	f.Location = restored
+	markerErr := os.WriteFile(restored+queue.DoneSuffix, nil, 0644)
+	if err := p.PFRepo.UpdateLocation(ctx, f.ID, restored); err != nil {
+		log.Printf("[restore] failed to record location %s of file %s: %v", restored, f.ID, err)
+	}
+	if markerErr != nil {
+		return fmt.Errorf("failed to create done marker for %s: %w", restored, markerErr)
+	}
+	return nil
+}
+
+// deleteData deletes the messages, parse errors and unit revisions of the file and resets its row to status
+// in one transaction, holding the lock on the content so no worker ingests it meanwhile. check runs inside
+// the transaction before anything is deleted, an error from it keeps the data. The units that had messages
+// or revisions from the file are returned.
+func (p *Processor) deleteData(
+	ctx context.Context,
+	id uuid.UUID,
+	status string,
+	check func(f *models.ProcessedFile) error,
+) (*models.ProcessedFile, []uuid.UUID, error) {
+	var file *models.ProcessedFile
+	var units []uuid.UUID
+
+	err := pgx.BeginFunc(ctx, p.DB, func(tx pgx.Tx) error {
+		pfRepo := p.PFRepo.WithTx(tx)
+		f, err := pfRepo.GetByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			return ErrFileNotFound
+		}
+		if err := pfRepo.LockContent(ctx, f.ContentHash); err != nil {
+			return err
+		}
+		// read again under the lock, a worker may have finished with the file while waiting for it
+		if f, err = pfRepo.GetByID(ctx, id); err != nil {
+			return err
+		}
+		if f.Status == models.FileStatusQueued || f.Status == models.FileStatusParsing {
+			return ErrFileBusy
+		}
+		if check != nil {
+			if err := check(f); err != nil {
+				return err
+			}
+		}
+
+		msgRepo := p.MsgRepo.WithTx(tx)
+		if units, err = msgRepo.UnitsBySourceFile(ctx, id); err != nil {
+			return err
+		}
+		messages, err := msgRepo.DeleteBySourceFile(ctx, id)
+		if err != nil {
+			return err
+		}
+		parseErrors, err := p.ErrRepo.WithTx(tx).DeleteByFile(ctx, id)
+		if err != nil {
+			return err
+		}
+		// the revisions made by the file go too, or the definitions of its units would still show its messages
+		revised, err := p.RevRepo.WithTx(tx).DeleteByFile(ctx, id)
+		if err != nil {
+			return err
+		}
+		for _, unit := range revised {
+			if !slices.Contains(units, unit) {
+				units = append(units, unit)
+			}
+		}
+		if err := pfRepo.Reset(ctx, id, status); err != nil {
+			return err
+		}
+		log.Printf("[worker] deleted %d messages and %d parse errors of file %s", messages, parseErrors, id)
+
+		f.Status = status
+		file = f
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, units, nil
+}
+
+// refreshReports regenerates the PDF reports of the units, removing the ones of units without messages
+func (p *Processor) refreshReports(ctx context.Context, units []uuid.UUID) {
+	for _, unitGUID := range units {
+		err := pdf.GenerateUnitPDF(ctx, p.OutDir, unitGUID, p.MsgRepo, p.PFRepo, p.RevRepo, p.ParseOpts.NaturalKey)
+		if errors.Is(err, pdf.ErrNoMessages) {
+			err = pdf.RemoveUnitPDF(p.OutDir, unitGUID)
+		}
+		if err != nil {
+			log.Printf("[worker] failed to refresh PDF for %s: %v", unitGUID, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package worker
+
+import (
+	"biocad-tsv-service/internal/archive"
+	"biocad-tsv-service/internal/config"
+	"biocad-tsv-service/internal/migrations"
+	"biocad-tsv-service/internal/models"
+	"biocad-tsv-service/internal/parser"
+	"biocad-tsv-service/internal/repository"
+	"context"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"os"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testProcessor connects to the database in TSV_TEST_DATABASE_URL, migrates it and returns a processor on it.
+// Without the variable the test is skipped.
+func testProcessor(t *testing.T) *Processor {
+	t.Helper()
+	dsn := os.Getenv("TSV_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TSV_TEST_DATABASE_URL is not set")
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+
+	migrator, err := migrations.New(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := repository.NewNaturalKey(config.DefaultNaturalKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewProcessor(
+		pool,
+		repository.NewMessageRepo(pool),
+		repository.NewProcessedFileRepo(pool),
+		repository.NewParseErrorRepo(pool),
+		repository.NewRevisionRepo(pool),
+		t.TempDir(),
+		t.TempDir(),
+		parser.Options{NaturalKey: key},
+		archive.New("", "", false, false),
+		config.RetryConfig{},
+	)
+}
+
+// ingest stores the messages of a file with the unit and records its revision, like an append-mode ingest
+func ingest(t *testing.T, p *Processor, unit uuid.UUID, msgIDs ...string) uuid.UUID {
+	t.Helper()
+	ctx := context.Background()
+
+	file := &models.ProcessedFile{
+		Filename:    "input/" + uuid.NewString() + ".tsv",
+		ContentHash: uuid.NewString(),
+		MTime:       time.Now(),
+		Status:      models.FileStatusSuccess,
+	}
+	if err := p.PFRepo.Insert(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := make([]*models.Message, 0, len(msgIDs))
+	for i, id := range msgIDs {
+		line := i + 2
+		msgs = append(msgs, &models.Message{
+			ID:           uuid.New(),
+			UnitGUID:     unit,
+			MsgId:        id,
+			Text:         "text of " + id,
+			CreatedAt:    time.Now(),
+			SourceFileID: &file.ID,
+			SourceLine:   &line,
+		})
+	}
+	err := pgx.BeginFunc(ctx, p.DB, func(tx pgx.Tx) error {
+		if _, err := p.MsgRepo.WithTx(tx).InsertBatch(ctx, msgs); err != nil {
+			return err
+		}
+		_, err := p.RevRepo.WithTx(tx).Record(ctx, file.ID, msgs, p.ParseOpts.NaturalKey)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file.ID
+}
+
+// definition reads the current definition of the unit the way GET /units/{guid}/definition does:
+// the msg_ids of the latest revision, nil if the unit has none
+func definition(t *testing.T, p *Processor, unit uuid.UUID) []string {
+	t.Helper()
+	ctx := context.Background()
+	rev, err := p.RevRepo.Latest(ctx, unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev == nil {
+		return nil
+	}
+	versions, err := p.RevRepo.Versions(ctx, unit, rev.Revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, len(versions))
+	for _, v := range versions {
+		ids = append(ids, v.MsgId)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestPurgeDefinition(t *testing.T) {
+	p := testProcessor(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		purge []int // indexes of the files to purge, in order
+		want  []string
+	}{
+		{name: "nothing purged", want: []string{"M1", "M3"}},
+		{name: "latest file purged", purge: []int{1}, want: []string{"M1", "M2"}},
+		{name: "first file purged", purge: []int{0}, want: []string{"M1", "M3"}},
+		{name: "every file purged", purge: []int{1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unit := uuid.New()
+			files := []uuid.UUID{
+				ingest(t, p, unit, "M1", "M2"),
+				ingest(t, p, unit, "M1", "M3"),
+			}
+			for _, i := range tt.purge {
+				if _, err := p.Purge(ctx, files[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := definition(t, p, unit); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("definition = %v, want %v", got, tt.want)
+			}
+
+			// the revisions of the purged files are gone
+			left, err := p.RevRepo.List(ctx, unit, 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(left) != len(files)-len(tt.purge) {
+				t.Errorf("%d revisions left, want %d", len(left), len(files)-len(tt.purge))
+			}
+			for _, rev := range left {
+				if rev.FileID != nil && slices.ContainsFunc(tt.purge, func(i int) bool { return files[i] == *rev.FileID }) {
+					t.Errorf("revision %d of a purged file is left", rev.Revision)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package worker
+
+import (
+	"biocad-tsv-service/internal/archive"
+	"biocad-tsv-service/internal/config"
+	"biocad-tsv-service/internal/models"
+	"biocad-tsv-service/internal/parser"
+	"biocad-tsv-service/internal/pdf"
+	"biocad-tsv-service/internal/queue"
+	"biocad-tsv-service/internal/repository"
+	"biocad-tsv-service/internal/util"
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"log"
+	"os"
+	"time"
+)
+
+// Processor runs a file through the ingest pipeline: parsing, PDF reports and archiving
+type Processor struct {
+	DB        *pgxpool.Pool
+	MsgRepo   *repository.MessageRepo
+	PFRepo    *repository.ProcessedFileRepo
+	ErrRepo   *repository.ParseErrorRepo
+	RevRepo   *repository.RevisionRepo
+	InputDir  string // where reprocessed files are put back
+	OutDir    string
+	ParseOpts parser.Options
+	Archiver  *archive.Archiver
+	Retry     config.RetryConfig
+}
+
+// NewProcessor creates a new Processor
+func NewProcessor(
+	db *pgxpool.Pool,
+	msgRepo *repository.MessageRepo,
+	pfRepo *repository.ProcessedFileRepo,
+	errRepo *repository.ParseErrorRepo,
+	revRepo *repository.RevisionRepo,
+	inputDir string,
+	outDir string,
+	parseOpts parser.Options,
+	archiver *archive.Archiver,
+	retry config.RetryConfig,
+) *Processor {
+	return &Processor{
+		DB:        db,
+		MsgRepo:   msgRepo,
+		PFRepo:    pfRepo,
+		ErrRepo:   errRepo,
+		RevRepo:   revRepo,
+		InputDir:  inputDir,
+		OutDir:    outDir,
+		ParseOpts: parseOpts,
+		Archiver:  archiver,
+		Retry:     retry,
+	}
+}
+
+// Run processes jobs from the queue until ctx is done or stop is canceled.
+// Canceling stop only keeps the worker from taking new jobs, the job in progress is finished,
+// while canceling ctx also interrupts it.
+// While a job is processed the worker sends a heartbeat every heartbeat interval.
+func Run(ctx, stop context.Context, id int, q queue.Queue, p *Processor, heartbeat time.Duration) {
+	log.Printf("[worker %d] started", id)
+	for {
+		job, err := q.Dequeue(stop)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Printf("[worker %d] context canceled, exiting", id)
+				return
+			}
+			if stop.Err() != nil {
+				log.Printf("[worker %d] stopped", id)
+				return
+			}
+			log.Printf("[worker %d] failed to take a job: %v", id, err)
+			continue
+		}
+
+		err = withHeartbeat(ctx, q, job, heartbeat, func(ctx context.Context) error {
+			return p.Process(ctx, id, job.File)
+		})
+		if err := q.Done(ctx, job, err); err != nil {
+			log.Printf("[worker %d] failed to release job for %s: %v", id, job.File, err)
+		}
+	}
+}
+
+// withHeartbeat runs fn and keeps the job alive in the queue meanwhile.
+// If the queue reports the job was taken over, fn's context is canceled. A zero interval sends no heartbeats.
+func withHeartbeat(ctx context.Context, q queue.Queue, job *queue.Job, interval time.Duration, fn func(context.Context) error) error {
+	if interval <= 0 {
+		return fn(ctx)
+	}
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-jobCtx.Done():
+				return
+			case <-ticker.C:
+				err := q.Heartbeat(jobCtx, job)
+				if errors.Is(err, repository.ErrLeaseLost) {
+					log.Printf("[worker] lost the job for %s, canceling", job.File)
+					cancel()
+					return
+				}
+				if err != nil && jobCtx.Err() == nil {
+					log.Printf("[worker] heartbeat for %s failed: %v", job.File, err)
+				}
+			}
+		}
+	}()
+
+	return fn(jobCtx)
+}
+
+// Process ingests one file, generates the PDF reports of its units and archives it.
+// Only an error of the ingest itself is returned, the later steps are logged.
+func (p *Processor) Process(ctx context.Context, id int, file string) error {
+	log.Printf("[worker %d] processing file: %s", id, file)
+	result, err := parser.ParseTSVFile(ctx, file, p.DB, p.MsgRepo, p.PFRepo, p.ErrRepo, p.RevRepo, p.ParseOpts)
+	if err != nil {
+		log.Printf("[worker %d] failed to parse file %s: %v", id, file, err)
+		p.recordFailure(ctx, id, file, err)
+		return err
+	}
+	log.Printf("[worker %d] successfully parsed file %s", id, file)
+
+	// generating a PDF for each unique unitGUID
+	unitGUIDMap := make(map[uuid.UUID]struct{})
+	for _, msg := range result.Messages {
+		unitGUIDMap[msg.UnitGUID] = struct{}{}
+	}
+
+	for unitGUID := range unitGUIDMap {
+		if err := pdf.GenerateUnitPDF(ctx, p.OutDir, unitGUID, p.MsgRepo, p.PFRepo, p.RevRepo, p.ParseOpts.NaturalKey); err != nil {
+			log.Printf("[worker %d] failed to generate PDF for %s: %v", id, unitGUID, err)
+		} else {
+			log.Printf("[worker %d] PDF generated for %s", id, unitGUID)
+		}
+	}
+
+	p.archive(ctx, id, file, result)
+	return nil
+}
+
+// archive moves a processed file out of the input directory and records where it went
+func (p *Processor) archive(ctx context.Context, id int, file string, result *parser.Result) {
+	// a skipped copy belongs to the row of the content processed earlier, which keeps its location
+	fileID := result.FileID
+	if result.Skipped {
+		fileID = uuid.Nil
+	}
+	p.moveFile(ctx, id, file, result.Status == models.FileStatusFailed, fileID)
+}
+
+// moveFile moves the file out of the input directory, to the failed one if failed, and records
+// its new location in the row with fileID. A nil fileID leaves the rows as they are.
+func (p *Processor) moveFile(ctx context.Context, id int, file string, failed bool, fileID uuid.UUID) {
+	location, err := p.Archiver.Move(file, failed)
+	if err != nil {
+		log.Printf("[worker %d] failed to archive file %s: %v", id, file, err)
+		return
+	}
+	if location != file {
+		log.Printf("[worker %d] moved file %s to %s", id, file, location)
+		if err := os.Remove(file + queue.DoneSuffix); err != nil && !os.IsNotExist(err) {
+			log.Printf("[worker %d] failed to remove done marker of %s: %v", id, file, err)
+		}
+	}
+
+	if fileID == uuid.Nil {
+		return
+	}
+	if err := p.PFRepo.UpdateLocation(ctx, fileID, location); err != nil {
+		log.Printf("[worker %d] failed to record location of %s: %v", id, file, err)
+	}
+}
+
+// recordFailure counts a failed ingest of the file, so the scanner retries it after a backoff
+// and gives up once the attempts are used up, moving a dead file to the failed directory.
+// Nothing is counted when the worker is stopping.
+func (p *Processor) recordFailure(ctx context.Context, id int, file string, cause error) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		log.Printf("[worker %d] failed to stat %s to record the failure: %v", id, file, err)
+		return
+	}
+	hash, err := util.HashFile(file)
+	if err != nil {
+		log.Printf("[worker %d] failed to hash %s to record the failure: %v", id, file, err)
+		return
+	}
+
+	pf := &models.ProcessedFile{
+		Filename:    file,
+		ContentHash: hash,
+		Size:        info.Size(),
+		MTime:       info.ModTime(),
+	}
+	failed, err := p.PFRepo.RecordFailure(ctx, pf, cause, p.Retry.MaxAttempts, p.Retry.Backoff, p.Retry.MaxBackoff)
+	if err != nil {
+		log.Printf("[worker %d] failed to record the failure of %s: %v", id, file, err)
+		return
+	}
+	switch {
+	case failed.Status == models.FileStatusDead:
+		log.Printf("[worker %d] file %s failed %d times, marked as dead", id, file, failed.Attempts)
+		// out of the input directory the scanner doesn't stat and hash it on every pass
+		p.moveFile(ctx, id, file, true, failed.ID)
+	case failed.Status != models.FileStatusRetry:
+		log.Printf("[worker %d] file %s failed, its content is %s already, the failure is not counted",
+			id, file, failed.Status)
+	case failed.NextAttemptAt != nil:
+		log.Printf("[worker %d] file %s failed %d times, next attempt at %s",
+			id, file, failed.Attempts, failed.NextAttemptAt.Format(time.RFC3339))
+	}
+}